@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/alafilearnstocode/ccrun/internal/registry"
+	"golang.org/x/sys/unix"
+)
+
+func loginCmd(args []string) {
+	fs := flag.NewFlagSet("login", flag.ExitOnError)
+	user := fs.String("u", "", "username")
+	fs.StringVar(user, "username", "", "username")
+	pass := fs.String("p", "", "password (prefer --password-stdin)")
+	fs.StringVar(pass, "password", "", "password (prefer --password-stdin)")
+	passStdin := fs.Bool("password-stdin", false, "read the password from stdin")
+	fs.Parse(args)
+
+	if fs.NArg() > 1 {
+		log.Fatal("usage: ccrun login [-u USER] [-p PASSWORD | --password-stdin] [SERVER]")
+	}
+	domain := registry.NormalizeServer(fs.Arg(0))
+
+	in := bufio.NewReader(os.Stdin)
+	switch {
+	case *passStdin && *pass != "":
+		log.Fatal("ccrun login: --password and --password-stdin are mutually exclusive")
+	case *passStdin:
+		if *user == "" {
+			log.Fatal("ccrun login: --password-stdin requires --username")
+		}
+		b, err := io.ReadAll(in)
+		if err != nil {
+			log.Fatal(err)
+		}
+		*pass = strings.TrimRight(string(b), "\r\n")
+	case *pass != "":
+		fmt.Fprintln(os.Stderr, "WARNING! Using --password on the command line is insecure. Use --password-stdin.")
+	}
+	if *user == "" {
+		fmt.Fprint(os.Stderr, "Username: ")
+		line, err := in.ReadString('\n')
+		if err != nil && line == "" {
+			log.Fatal("ccrun login: no username")
+		}
+		*user = strings.TrimSpace(line)
+	}
+	if *pass == "" && !*passStdin {
+		p, err := readPassword(in)
+		if err != nil {
+			log.Fatal(err)
+		}
+		*pass = p
+	}
+	if *user == "" || *pass == "" {
+		log.Fatal("ccrun login: username and password are required")
+	}
+
+	creds := registry.Credentials{Username: *user, Password: *pass}
+	if err := registry.Login(domain, creds); err != nil {
+		log.Fatal(err)
+	}
+	if err := registry.SaveCredentials(domain, creds); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Login Succeeded")
+}
+
+func logoutCmd(args []string) {
+	fs := flag.NewFlagSet("logout", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		log.Fatal("usage: ccrun logout [SERVER]")
+	}
+	domain := registry.NormalizeServer(fs.Arg(0))
+	found, err := registry.EraseCredentials(domain)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !found {
+		fmt.Printf("Not logged in to %s\n", domain)
+		return
+	}
+	fmt.Printf("Removed login credentials for %s\n", domain)
+}
+
+// readPassword prompts for a password, with echo turned off if stdin is
+// a terminal.
+func readPassword(in *bufio.Reader) (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	fd := int(os.Stdin.Fd())
+	if t, err := unix.IoctlGetTermios(fd, unix.TCGETS); err == nil {
+		noecho := *t
+		noecho.Lflag &^= unix.ECHO
+		if err := unix.IoctlSetTermios(fd, unix.TCSETS, &noecho); err != nil {
+			return "", err
+		}
+		defer func() {
+			unix.IoctlSetTermios(fd, unix.TCSETS, t)
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+	line, err := in.ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("ccrun login: no password")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -1,15 +1,22 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"syscall"
+	"text/tabwriter"
 
+	"github.com/alafilearnstocode/ccrun/internal/network"
 	"github.com/alafilearnstocode/ccrun/internal/ns"
 	"github.com/alafilearnstocode/ccrun/internal/registry"
+	"github.com/alafilearnstocode/ccrun/internal/rootfs"
 	"github.com/alafilearnstocode/ccrun/internal/run"
+	"github.com/alafilearnstocode/ccrun/internal/volume"
 )
 
 func imagesDir() string {
@@ -19,6 +26,52 @@ func imagesDir() string {
 	return "images"
 }
 
+func stateDir() string {
+	if v := os.Getenv("CCRUN_STATE_DIR"); v != "" {
+		return v
+	}
+	return filepath.Join(filepath.Dir(imagesDir()), "state")
+}
+
+// pullOptions returns the options for pulling ref into dir: the blob
+// store and unpacked layers are shared by all images there, owners are
+// shifted for the user namespace with uidMap and gidMap (the default
+// one where they are nil), and any credentials stored by ccrun login
+// (or docker login) for ref's registry are used once it asks for them.
+func pullOptions(dir string, ref registry.ImageRef, uidMap, gidMap []syscall.SysProcIDMap) registry.PullOptions {
+	defUIDMap, defGIDMap := ns.DefaultIDMaps()
+	if len(uidMap) == 0 {
+		uidMap = defUIDMap
+	}
+	if len(gidMap) == 0 {
+		gidMap = defGIDMap
+	}
+	blobs := registry.NewBlobStore(filepath.Join(dir, "blobs"))
+	return registry.PullOptions{
+		UIDMap:    uidMap,
+		GIDMap:    gidMap,
+		Unpack:    ns.LayerUnpacker(blobs, uidMap, gidMap),
+		Blobs:     blobs,
+		LayersDir: filepath.Join(dir, "layers"),
+		LookupCredentials: func() (*registry.Credentials, error) {
+			return registry.LoadCredentials(ref.Domain)
+		},
+	}
+}
+
+// parsePlatform parses a --platform flag; empty means this machine's
+// platform.
+func parsePlatform(s string) registry.Platform {
+	if s == "" {
+		return registry.DefaultPlatform()
+	}
+	p, err := registry.ParsePlatform(s)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return p
+}
+
 // repeatable --env flags
 type arrayFlags []string
 
@@ -36,8 +89,22 @@ func main() {
 		runCmd(os.Args[2:])
 	case "pull":
 		pullCmd(os.Args[2:])
+	case "login":
+		loginCmd(os.Args[2:])
+	case "logout":
+		logoutCmd(os.Args[2:])
+	case "volume":
+		volumeCmd(os.Args[2:])
 	case "__ccrun_child__":
 		ns.ChildMain()
+	case "__ccrun_unpack__":
+		ns.UnpackMain()
+	case "__ccrun_seed__":
+		ns.SeedMain()
+	case "__ccrun_remove__":
+		ns.RemoveMain()
+	case "__ccrun_snapshot__":
+		ns.SnapshotMain()
 	default:
 		usage()
 	}
@@ -46,8 +113,11 @@ func main() {
 func usage() {
 	fmt.Fprintln(os.Stderr,
 		"Usage:\n"+
-			"  ccrun run [--hostname NAME] [--rootfs PATH] [--pidns] [--mntns] [--userns] [--mem MB] [--cpu PCT] [--workdir DIR] [--env K=V] -- <command> [args...]\n"+
-			"  ccrun pull [--out DIR] <image[:tag]>",
+			"  ccrun run [--hostname NAME] [--rootfs PATH] [--pidns] [--mntns] [--userns] [--uidmap C:H:N] [--gidmap C:H:N] [--netns] [--ipcns] [--cgroupns] [--timens] [--time-offset CLOCK=DUR] [--network none|bridge] [--subnet CIDR] [-p HOST:CTR[/tcp|udp]] [--dns IP] [--dns-search DOMAIN] [--add-host NAME:IP] [--mask-path PATH] [--readonly-path PATH] [--no-default-masks] [-v SRC|VOLUME:DST[:ro]] [--tmpfs PATH[:OPTS]] [--mem MB] [--cpu PCT] [--max-concurrent-downloads N] [--platform OS/ARCH[/VARIANT]] [--workdir DIR] [--env K=V] [--entrypoint CMD] [--user USER[:GROUP]] [--group-add GROUP] <image | --rootfs PATH> [-- <command> [args...]]\n"+
+			"  ccrun pull [--out DIR] [--max-concurrent-downloads N] [--platform OS/ARCH[/VARIANT]] [--progress bars|json] <[registry/]name[:tag][@digest]>\n"+
+			"  ccrun login [-u USER] [-p PASSWORD | --password-stdin] [SERVER]\n"+
+			"  ccrun logout [SERVER]\n"+
+			"  ccrun volume create|ls|inspect|rm [-f] [NAME...]",
 	)
 	os.Exit(2)
 }
@@ -56,15 +126,45 @@ func runCmd(args []string) {
 	fs := flag.NewFlagSet("run", flag.ExitOnError)
 
 	hostname := fs.String("hostname", "", "UTS hostname inside container")
-	root := fs.String("rootfs", "", "path to container rootfs (chroot)")
+	root := fs.String("rootfs", "", "path to container rootfs (pivot_root)")
 	pidns := fs.Bool("pidns", false, "use new PID namespace")
 	mntns := fs.Bool("mntns", false, "use new mount namespace")
 	userns := fs.Bool("userns", false, "use new user namespace (rootless)")
+	var uidMapSpecs, gidMapSpecs arrayFlags
+	fs.Var(&uidMapSpecs, "uidmap", "user namespace uid mapping containerID:hostID:size (repeatable, default from /etc/subuid)")
+	fs.Var(&gidMapSpecs, "gidmap", "user namespace gid mapping containerID:hostID:size (repeatable, default from /etc/subgid)")
+	netns := fs.Bool("netns", false, "use new network namespace (loopback only)")
+	ipcns := fs.Bool("ipcns", false, "use new IPC namespace")
+	cgroupns := fs.Bool("cgroupns", false, "use new cgroup namespace")
+	timens := fs.Bool("timens", false, "use new time namespace")
+	var timeOffsets arrayFlags
+	fs.Var(&timeOffsets, "time-offset", "time namespace offset, monotonic=DUR or boottime=DUR (repeatable, implies --timens)")
+	netMode := fs.String("network", "", "network mode: none or bridge (default: share host network)")
+	subnet := fs.String("subnet", network.DefaultSubnet, "subnet for the ccrun0 bridge")
 	memMB := fs.Int64("mem", 0, "memory limit in MB (0 = unlimited)")
 	cpuPct := fs.Int("cpu", 0, "CPU limit in percent (0 or >=100 = unlimited)")
+	maxDownloads := fs.Int("max-concurrent-downloads", registry.DefaultMaxConcurrentDownloads, "number of layers to download in parallel when pulling")
+	platform := fs.String("platform", "", "image platform as os/arch[/variant] (default: this machine's)")
 	workdir := fs.String("workdir", "", "working directory inside container")
+	entrypoint := fs.String("entrypoint", "", "override the image entrypoint")
+	userFlag := fs.String("user", "", "user[:group] to run as, by name or id (overrides the image USER)")
+	var groupAdd arrayFlags
+	fs.Var(&groupAdd, "group-add", "additional group to run with, by name or id (repeatable)")
 	var envs arrayFlags
 	fs.Var(&envs, "env", "environment variable KEY=VAL (repeatable)")
+	var dns, dnsSearch, addHosts arrayFlags
+	fs.Var(&dns, "dns", "nameserver for the container's resolv.conf (repeatable)")
+	fs.Var(&dnsSearch, "dns-search", "search domain for the container's resolv.conf (repeatable)")
+	fs.Var(&addHosts, "add-host", "extra NAME:IP line for the container's /etc/hosts (repeatable)")
+	var maskPaths, roPaths arrayFlags
+	fs.Var(&maskPaths, "mask-path", "extra path to hide inside the container (repeatable)")
+	fs.Var(&roPaths, "readonly-path", "extra path to make read-only inside the container (repeatable)")
+	noDefaultMasks := fs.Bool("no-default-masks", false, "do not mask or protect the default /proc and /sys paths")
+	var volumeSpecs, tmpfsSpecs arrayFlags
+	fs.Var(&volumeSpecs, "v", "bind mount hostPath|volume:containerPath[:ro|rw] (repeatable)")
+	fs.Var(&tmpfsSpecs, "tmpfs", "mount a tmpfs at path[:size=N,...] (repeatable)")
+	var publish arrayFlags
+	fs.Var(&publish, "p", "publish hostPort:containerPort[/tcp|udp] (repeatable, implies --network bridge)")
 
 	fs.Parse(args)
 	rest := fs.Args()
@@ -90,22 +190,55 @@ func runCmd(args []string) {
 		cmdArgs = rest
 	}
 
+	var uidMaps, gidMaps []syscall.SysProcIDMap
+	for _, m := range uidMapSpecs {
+		im, err := ns.ParseIDMap(m)
+		if err != nil {
+			log.Fatal(err)
+		}
+		uidMaps = append(uidMaps, im)
+	}
+	for _, m := range gidMapSpecs {
+		im, err := ns.ParseIDMap(m)
+		if err != nil {
+			log.Fatal(err)
+		}
+		gidMaps = append(gidMaps, im)
+	}
+	if len(uidMaps)+len(gidMaps) > 0 {
+		*userns = true
+	}
+
+	// Images are run from a private snapshot of their layers; the layer
+	// directories themselves are never written to.
+	var imageDir string
+	var layers []string
 	if *root == "" && imageRef != "" {
 		ref, err := registry.ParseImageRef(imageRef)
 		if err != nil {
 			log.Fatal(err)
 		}
-		dest := filepath.Join(imagesDir(), ref.RepoPath(), ref.Tag)
+		imageDir = filepath.Join(imagesDir(), ref.RepoPath(), ref.Reference())
 
-		if _, err := os.Stat(filepath.Join(dest, "rootfs")); err != nil {
-			if err := registry.Pull(ref, dest); err != nil {
+		// layers are unpacked with owners shifted to match the user
+		// namespace the container will run in
+		opts := pullOptions(imagesDir(), ref, uidMaps, gidMaps)
+		opts.MaxConcurrentDownloads = *maxDownloads
+		opts.Platform = parsePlatform(*platform)
+		layers, err = registry.ImageLayers(imageDir, opts)
+		if errors.Is(err, os.ErrNotExist) {
+			if err := registry.Pull(ref, imageDir, opts); err != nil {
 				log.Fatal(err)
 			}
+			layers, err = registry.ImageLayers(imageDir, opts)
+		}
+		if err != nil {
+			log.Fatal(err)
 		}
-		*root = filepath.Join(dest, "rootfs")
 	}
+	hasRoot := *root != "" || len(layers) > 0
 
-	if *root != "" {
+	if hasRoot {
 		if !*mntns {
 			*mntns = true
 		}
@@ -118,11 +251,101 @@ func runCmd(args []string) {
 		}
 	}
 
+	// Images pulled by registry.Pull keep their config.json next to the
+	// layers, or next to the rootfs for older pulls; use it for whatever
+	// the command line does not specify. Any other config.json next to a
+	// --rootfs, such as an OCI bundle's, is not an image config.
+	if *root != "" && registry.IsImageDir(filepath.Dir(*root)) {
+		imageDir = filepath.Dir(*root)
+	}
+	var imgCfg *registry.ImageConfig
+	if imageDir != "" {
+		c, err := registry.LoadImageConfig(filepath.Join(imageDir, "config.json"))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Fatal(err)
+		}
+		imgCfg = c
+	}
+	ep := []string(nil)
+	if *entrypoint != "" {
+		ep = []string{*entrypoint}
+	}
+	user := *userFlag
+	if imgCfg != nil {
+		c := imgCfg.Config
+		if *entrypoint == "" {
+			ep = c.Entrypoint
+			if len(cmdArgs) == 0 {
+				cmdArgs = c.Cmd
+			}
+		}
+		envs = append(append(arrayFlags{}, c.Env...), envs...)
+		if *workdir == "" {
+			*workdir = c.WorkingDir
+		}
+		if user == "" {
+			user = c.User
+		}
+	}
+	cmdArgs = append(append([]string{}, ep...), cmdArgs...)
+
+	var volumes []rootfs.BindMount
+	for _, v := range volumeSpecs {
+		m, err := rootfs.ParseBindMount(v)
+		if err != nil {
+			log.Fatal(err)
+		}
+		volumes = append(volumes, m)
+	}
+	var tmpfs []rootfs.TmpfsMount
+	for _, t := range tmpfsSpecs {
+		m, err := rootfs.ParseTmpfsMount(t)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tmpfs = append(tmpfs, m)
+	}
+	if (len(volumes) > 0 || len(tmpfs) > 0) && !hasRoot {
+		log.Fatal("-v and --tmpfs need a rootfs or image")
+	}
+
+	var ports []network.PortMapping
+	for _, p := range publish {
+		pm, err := network.ParsePortMapping(p)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ports = append(ports, pm)
+	}
+	if len(ports) > 0 {
+		if *netMode == "" {
+			*netMode = "bridge"
+		} else if *netMode != "bridge" {
+			log.Fatal("-p requires --network bridge")
+		}
+	}
+
+	for _, o := range timeOffsets {
+		if _, err := ns.ParseTimeOffset(o); err != nil {
+			log.Fatal(err)
+		}
+		*timens = true
+	}
+
+	switch *netMode {
+	case "", "host":
+		*netMode = ""
+	case "none", "bridge":
+		*netns = true
+	default:
+		log.Fatalf("unknown --network mode %q", *netMode)
+	}
+
 	if len(cmdArgs) == 0 {
 		log.Fatal("no command provided")
 	}
 
-	if *hostname == "" && *root == "" && !*pidns && !*mntns && !*userns && *memMB == 0 && *cpuPct == 0 && *workdir == "" && len(envs) == 0 {
+	if *hostname == "" && !hasRoot && !*pidns && !*mntns && !*userns && !*netns && !*ipcns && !*cgroupns && !*timens && *memMB == 0 && *cpuPct == 0 && *workdir == "" && len(envs) == 0 && *userFlag == "" && len(groupAdd) == 0 {
 		code, err := run.ExecPassthrough(cmdArgs[0], cmdArgs[1:], os.Environ())
 		if err != nil && code == 0 {
 			code = 1
@@ -130,17 +353,49 @@ func runCmd(args []string) {
 		os.Exit(code)
 	}
 
+	var masked, readonly []string
+	if !*noDefaultMasks {
+		masked = append(masked, rootfs.DefaultMaskedPaths...)
+		readonly = append(readonly, rootfs.DefaultReadonlyPaths...)
+	}
+	masked = append(masked, maskPaths...)
+	readonly = append(readonly, roPaths...)
+
 	cfg := ns.Config{
 		Hostname: *hostname,
 		UseUTS:   *hostname != "",
 		Rootfs:   *root,
+		Layers:   layers,
 		UsePID:   *pidns,
 		UseMNT:   *mntns,
 		UseUSER:  *userns,
+		UseNET:   *netns,
+		UseIPC:   *ipcns,
+		UseCG:    *cgroupns,
+		UseTIME:  *timens,
+		Network:  *netMode,
+		Subnet:   *subnet,
+		StateDir: stateDir(),
+		Ports:    ports,
 		MemBytes: *memMB * 1024 * 1024,
 		CPUPct:   *cpuPct,
 		Workdir:  *workdir,
+		User:     user,
+		GroupAdd: groupAdd,
+		UIDMaps:  uidMaps,
+		GIDMaps:  gidMaps,
 		Env:      envs,
+
+		DNS:         dns,
+		DNSSearch:   dnsSearch,
+		ExtraHosts:  addHosts,
+		TimeOffsets: timeOffsets,
+
+		MaskedPaths:   masked,
+		ReadonlyPaths: readonly,
+
+		Volumes: volumes,
+		Tmpfs:   tmpfs,
 	}
 	code, err := ns.SpawnChild(cfg, cmdArgs[0], cmdArgs[1:])
 	if err != nil && code == 0 {
@@ -152,10 +407,13 @@ func runCmd(args []string) {
 func pullCmd(args []string) {
 	fs := flag.NewFlagSet("pull", flag.ExitOnError)
 	outDir := fs.String("out", "images", "output images directory")
+	maxDownloads := fs.Int("max-concurrent-downloads", registry.DefaultMaxConcurrentDownloads, "number of layers to download in parallel")
+	platform := fs.String("platform", "", "image platform as os/arch[/variant] (default: this machine's)")
+	progressMode := fs.String("progress", "bars", "progress output: bars or json (one JSON event per line)")
 	fs.Parse(args)
 
 	if fs.NArg() != 1 {
-		log.Fatal("usage: ccrun pull [--out DIR] <image[:tag]>")
+		log.Fatal("usage: ccrun pull [--out DIR] [--max-concurrent-downloads N] [--platform OS/ARCH[/VARIANT]] [--progress bars|json] <[registry/]name[:tag][@digest]>")
 	}
 
 	ref, err := registry.ParseImageRef(fs.Arg(0))
@@ -163,10 +421,86 @@ func pullCmd(args []string) {
 		log.Fatal(err)
 	}
 
-	dest := filepath.Join(*outDir, ref.RepoPath(), ref.Tag)
-	if err := registry.Pull(ref, dest); err != nil {
+	dest := filepath.Join(*outDir, ref.RepoPath(), ref.Reference())
+	progress, err := newProgress(*progressMode, os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := pullOptions(*outDir, ref, nil, nil)
+	opts.MaxConcurrentDownloads = *maxDownloads
+	opts.Platform = parsePlatform(*platform)
+	opts.Progress = progress
+	if err := registry.Pull(ref, dest, opts); err != nil {
 		log.Fatal(err)
 	}
+	if *progressMode == "json" {
+		// keep stdout a pure event stream
+		return
+	}
 
 	fmt.Printf("Pulled %s to %s\n", ref.String(), dest)
 }
+
+func volumeCmd(args []string) {
+	if len(args) < 1 {
+		usage()
+	}
+	sub, args := args[0], args[1:]
+
+	switch sub {
+	case "create":
+		if len(args) != 1 {
+			log.Fatal("usage: ccrun volume create NAME")
+		}
+		v, err := volume.Create(stateDir(), args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(v.Name)
+	case "ls":
+		vols, err := volume.List(stateDir())
+		if err != nil {
+			log.Fatal(err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tIN USE\tMOUNTPOINT")
+		for _, v := range vols {
+			fmt.Fprintf(tw, "%s\t%d\t%s\n", v.Name, len(v.Users), v.Mountpoint)
+		}
+		tw.Flush()
+	case "inspect":
+		if len(args) == 0 {
+			log.Fatal("usage: ccrun volume inspect NAME...")
+		}
+		var vols []*volume.Volume
+		for _, name := range args {
+			v, err := volume.Inspect(stateDir(), name)
+			if err != nil {
+				log.Fatal(err)
+			}
+			vols = append(vols, v)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(vols); err != nil {
+			log.Fatal(err)
+		}
+	case "rm":
+		fs := flag.NewFlagSet("volume rm", flag.ExitOnError)
+		force := fs.Bool("f", false, "remove even if in use")
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			log.Fatal("usage: ccrun volume rm [-f] NAME...")
+		}
+		// rootless volumes hold files of subordinate ids
+		remove := ns.Remover(ns.DefaultIDMaps())
+		for _, name := range fs.Args() {
+			if err := volume.Remove(stateDir(), name, *force, remove); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println(name)
+		}
+	default:
+		usage()
+	}
+}
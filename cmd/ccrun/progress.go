@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/alafilearnstocode/ccrun/internal/registry"
+	"golang.org/x/sys/unix"
+)
+
+// newProgress returns the pull progress reporter for a --progress mode.
+func newProgress(mode string, w *os.File) (registry.Progress, error) {
+	switch mode {
+	case "bars":
+		_, err := unix.IoctlGetTermios(int(w.Fd()), unix.TCGETS)
+		return &barProgress{w: w, tty: err == nil, layers: map[string]registry.ProgressEvent{}}, nil
+	case "json":
+		return &jsonProgress{enc: json.NewEncoder(w)}, nil
+	default:
+		return nil, fmt.Errorf("unknown --progress mode %q (want bars or json)", mode)
+	}
+}
+
+// jsonProgress writes every event as a line of JSON.
+type jsonProgress struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (p *jsonProgress) Update(ev registry.ProgressEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.enc.Encode(ev)
+}
+
+// barProgress draws one line per layer. On a terminal the lines are
+// redrawn in place; otherwise a line is printed whenever a layer changes
+// state.
+type barProgress struct {
+	mu     sync.Mutex
+	w      io.Writer
+	tty    bool
+	order  []string
+	layers map[string]registry.ProgressEvent
+	drawn  int
+}
+
+func (p *barProgress) Update(ev registry.ProgressEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	prev, seen := p.layers[ev.Layer]
+	if !seen {
+		p.order = append(p.order, ev.Layer)
+	}
+	p.layers[ev.Layer] = ev
+
+	if !p.tty {
+		if !seen || prev.Status != ev.Status {
+			fmt.Fprintln(p.w, progressLine(ev))
+		}
+		return
+	}
+	if p.drawn > 0 {
+		fmt.Fprintf(p.w, "\x1b[%dA", p.drawn)
+	}
+	for _, l := range p.order {
+		fmt.Fprintf(p.w, "\x1b[2K%s\n", progressLine(p.layers[l]))
+	}
+	p.drawn = len(p.order)
+}
+
+const barWidth = 30
+
+func progressLine(ev registry.ProgressEvent) string {
+	id := strings.TrimPrefix(ev.Layer, "sha256:")
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	switch ev.Status {
+	case registry.StatusDownloading:
+		bar := strings.Repeat(" ", barWidth)
+		if ev.Total > 0 {
+			n := int(min(ev.Current, ev.Total) * barWidth / ev.Total)
+			bar = strings.Repeat("=", n) + strings.Repeat(" ", barWidth-n)
+			if n < barWidth {
+				bar = bar[:n] + ">" + bar[n+1:]
+			}
+		}
+		return fmt.Sprintf("%s: %-11s [%s] %s/%s", id, ev.Status, bar, humanBytes(ev.Current), humanBytes(ev.Total))
+	case registry.StatusFailed:
+		return fmt.Sprintf("%s: %s: %s", id, ev.Status, ev.Error)
+	default:
+		return fmt.Sprintf("%s: %s", id, ev.Status)
+	}
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
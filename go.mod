@@ -1,3 +1,8 @@
 module github.com/alafilearnstocode/ccrun
 
-go 1.25.1
+go 1.26.0
+
+require (
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/sys v0.48.0
+)
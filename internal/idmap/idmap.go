@@ -0,0 +1,28 @@
+// Package idmap translates ids through the id maps of a user namespace.
+package idmap
+
+import "syscall"
+
+// OverflowID is what the kernel shows for ids that a user namespace does
+// not map.
+const OverflowID = 65534
+
+// HostID returns the host id that id in the container maps to. Without
+// maps, ids are kept. An id that the maps do not cover becomes the
+// container's overflow id instead, or the host's if that is not mapped
+// either: keeping it would hand files to an unrelated host user outside
+// the container's range.
+func HostID(maps []syscall.SysProcIDMap, id int) int {
+	if len(maps) == 0 {
+		return id
+	}
+	for _, m := range maps {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + id - m.ContainerID
+		}
+	}
+	if id != OverflowID {
+		return HostID(maps, OverflowID)
+	}
+	return OverflowID
+}
@@ -0,0 +1,27 @@
+package idmap
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestHostID(t *testing.T) {
+	big := []syscall.SysProcIDMap{{ContainerID: 0, HostID: 100000, Size: 65536}}
+	small := []syscall.SysProcIDMap{{ContainerID: 0, HostID: 100000, Size: 1000}}
+	for _, tt := range []struct {
+		maps     []syscall.SysProcIDMap
+		id, want int
+	}{
+		{big, 0, 100000},
+		{big, 1000, 101000},
+		// beyond the range: the container's overflow id
+		{big, 70000, 100000 + OverflowID},
+		// without the overflow id in range, the host's
+		{small, 70000, OverflowID},
+		{nil, 70000, 70000},
+	} {
+		if got := HostID(tt.maps, tt.id); got != tt.want {
+			t.Errorf("HostID(%v, %d) = %d, want %d", tt.maps, tt.id, got, tt.want)
+		}
+	}
+}
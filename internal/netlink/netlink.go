@@ -0,0 +1,241 @@
+package netlink
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var seq uint32
+
+type attr struct {
+	typ  uint16
+	data []byte
+	kids []*attr
+}
+
+func newAttr(typ uint16, data []byte) *attr { return &attr{typ: typ, data: data} }
+
+func (a *attr) add(kid *attr) *attr { a.kids = append(a.kids, kid); return a }
+
+func (a *attr) encode() []byte {
+	body := append([]byte{}, a.data...)
+	for _, k := range a.kids {
+		body = append(body, k.encode()...)
+	}
+	l := unix.SizeofRtAttr + len(body)
+	b := make([]byte, align(l))
+	binary.NativeEndian.PutUint16(b[0:], uint16(l))
+	binary.NativeEndian.PutUint16(b[2:], a.typ)
+	copy(b[unix.SizeofRtAttr:], body)
+	return b
+}
+
+func align(n int) int { return (n + unix.NLMSG_ALIGNTO - 1) &^ (unix.NLMSG_ALIGNTO - 1) }
+
+func cstr(s string) []byte { return append([]byte(s), 0) }
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.NativeEndian.PutUint32(b, v)
+	return b
+}
+
+func ifInfo(index int, flags, change uint32) []byte {
+	msg := unix.IfInfomsg{Family: unix.AF_UNSPEC, Index: int32(index), Flags: flags, Change: change}
+	return (*[unix.SizeofIfInfomsg]byte)(unsafe.Pointer(&msg))[:]
+}
+
+// request sends a single netlink route request and waits for its ack.
+func request(typ uint16, flags uint16, payload []byte, attrs ...*attr) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("netlink socket: %w", err)
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return fmt.Errorf("netlink bind: %w", err)
+	}
+
+	body := append([]byte{}, payload...)
+	body = append(body, make([]byte, align(len(body))-len(body))...)
+	for _, a := range attrs {
+		body = append(body, a.encode()...)
+	}
+
+	s := atomic.AddUint32(&seq, 1)
+	hdr := make([]byte, unix.SizeofNlMsghdr)
+	binary.NativeEndian.PutUint32(hdr[0:], uint32(unix.SizeofNlMsghdr+len(body)))
+	binary.NativeEndian.PutUint16(hdr[4:], typ)
+	binary.NativeEndian.PutUint16(hdr[6:], flags|unix.NLM_F_REQUEST|unix.NLM_F_ACK)
+	binary.NativeEndian.PutUint32(hdr[8:], s)
+
+	if err := unix.Sendto(fd, append(hdr, body...), 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return fmt.Errorf("netlink send: %w", err)
+	}
+
+	buf := make([]byte, unix.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return fmt.Errorf("netlink recv: %w", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return fmt.Errorf("netlink parse: %w", err)
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != s {
+				continue
+			}
+			if m.Header.Type == unix.NLMSG_ERROR {
+				if len(m.Data) < 4 {
+					return fmt.Errorf("netlink: short error message")
+				}
+				if errno := int32(binary.NativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+					return unix.Errno(-errno)
+				}
+				return nil
+			}
+		}
+	}
+}
+
+func linkIndex(name string) (int, error) {
+	ifc, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, err
+	}
+	return ifc.Index, nil
+}
+
+// LinkUp sets the IFF_UP flag on the named interface.
+func LinkUp(name string) error {
+	idx, err := linkIndex(name)
+	if err != nil {
+		return fmt.Errorf("link %s: %w", name, err)
+	}
+	if err := request(unix.RTM_NEWLINK, 0, ifInfo(idx, unix.IFF_UP, unix.IFF_UP)); err != nil {
+		return fmt.Errorf("link %s up: %w", name, err)
+	}
+	return nil
+}
+
+// LinkDel removes the named interface. Deleting one end of a veth pair
+// removes its peer as well.
+func LinkDel(name string) error {
+	idx, err := linkIndex(name)
+	if err != nil {
+		return fmt.Errorf("link %s: %w", name, err)
+	}
+	if err := request(unix.RTM_DELLINK, 0, ifInfo(idx, 0, 0)); err != nil {
+		return fmt.Errorf("link %s del: %w", name, err)
+	}
+	return nil
+}
+
+// AddBridge creates a bridge device. An existing device of the same name
+// is not an error.
+func AddBridge(name string) error {
+	info := newAttr(unix.IFLA_LINKINFO, nil).add(newAttr(unix.IFLA_INFO_KIND, cstr("bridge")))
+	err := request(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, ifInfo(0, 0, 0),
+		newAttr(unix.IFLA_IFNAME, cstr(name)), info)
+	if err != nil && err != unix.EEXIST {
+		return fmt.Errorf("add bridge %s: %w", name, err)
+	}
+	return nil
+}
+
+// AddVeth creates a veth pair named name and peer.
+func AddVeth(name, peer string) error {
+	const vethInfoPeer = 1
+	peerAttr := newAttr(vethInfoPeer, ifInfo(0, 0, 0)).add(newAttr(unix.IFLA_IFNAME, cstr(peer)))
+	info := newAttr(unix.IFLA_LINKINFO, nil).
+		add(newAttr(unix.IFLA_INFO_KIND, cstr("veth"))).
+		add(newAttr(unix.IFLA_INFO_DATA, nil).add(peerAttr))
+	err := request(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, ifInfo(0, 0, 0),
+		newAttr(unix.IFLA_IFNAME, cstr(name)), info)
+	if err != nil {
+		return fmt.Errorf("add veth %s/%s: %w", name, peer, err)
+	}
+	return nil
+}
+
+// SetMaster enslaves the named interface to master (e.g. a bridge).
+func SetMaster(name, master string) error {
+	idx, err := linkIndex(name)
+	if err != nil {
+		return fmt.Errorf("link %s: %w", name, err)
+	}
+	midx, err := linkIndex(master)
+	if err != nil {
+		return fmt.Errorf("link %s: %w", master, err)
+	}
+	if err := request(unix.RTM_NEWLINK, 0, ifInfo(idx, 0, 0), newAttr(unix.IFLA_MASTER, u32(uint32(midx)))); err != nil {
+		return fmt.Errorf("link %s master %s: %w", name, master, err)
+	}
+	return nil
+}
+
+// SetNsPid moves the named interface into the network namespace of pid,
+// renaming it to newName on the way.
+func SetNsPid(name string, pid int, newName string) error {
+	idx, err := linkIndex(name)
+	if err != nil {
+		return fmt.Errorf("link %s: %w", name, err)
+	}
+	err = request(unix.RTM_NEWLINK, 0, ifInfo(idx, 0, 0),
+		newAttr(unix.IFLA_NET_NS_PID, u32(uint32(pid))),
+		newAttr(unix.IFLA_IFNAME, cstr(newName)))
+	if err != nil {
+		return fmt.Errorf("link %s netns %d: %w", name, pid, err)
+	}
+	return nil
+}
+
+// AddAddr assigns an IPv4 address to the named interface. An address
+// that is already present is not an error.
+func AddAddr(name string, addr *net.IPNet) error {
+	idx, err := linkIndex(name)
+	if err != nil {
+		return fmt.Errorf("link %s: %w", name, err)
+	}
+	ip := addr.IP.To4()
+	if ip == nil {
+		return fmt.Errorf("addr %s: only IPv4 is supported", addr)
+	}
+	ones, _ := addr.Mask.Size()
+	msg := unix.IfAddrmsg{Family: unix.AF_INET, Prefixlen: uint8(ones), Index: uint32(idx)}
+	payload := (*[unix.SizeofIfAddrmsg]byte)(unsafe.Pointer(&msg))[:]
+	err = request(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL, payload,
+		newAttr(unix.IFA_LOCAL, ip), newAttr(unix.IFA_ADDRESS, ip))
+	if err != nil && err != unix.EEXIST {
+		return fmt.Errorf("addr %s on %s: %w", addr, name, err)
+	}
+	return nil
+}
+
+// AddDefaultRoute installs an IPv4 default route via gw.
+func AddDefaultRoute(gw net.IP) error {
+	ip := gw.To4()
+	if ip == nil {
+		return fmt.Errorf("route via %s: only IPv4 is supported", gw)
+	}
+	msg := unix.RtMsg{
+		Family:   unix.AF_INET,
+		Table:    unix.RT_TABLE_MAIN,
+		Protocol: unix.RTPROT_BOOT,
+		Scope:    unix.RT_SCOPE_UNIVERSE,
+		Type:     unix.RTN_UNICAST,
+	}
+	payload := (*[unix.SizeofRtMsg]byte)(unsafe.Pointer(&msg))[:]
+	if err := request(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, payload, newAttr(unix.RTA_GATEWAY, ip)); err != nil {
+		return fmt.Errorf("default route via %s: %w", gw, err)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var defaultDNS = []string{"8.8.8.8", "8.8.4.4"}
+
+// hostResolvConf is where the host's resolver configuration is read
+// from. It is a variable for tests.
+var hostResolvConf = "/etc/resolv.conf"
+
+// EtcConfig describes the name resolution files generated for a container.
+type EtcConfig struct {
+	Hostname   string
+	IP         net.IP   // container address, nil without a bridge network
+	OwnNetns   bool     // host loopback resolvers are unreachable
+	DNS        []string // overrides the host nameservers
+	DNSSearch  []string // overrides the host search domains
+	ExtraHosts []string // name:ip
+}
+
+// EtcFiles lists the generated files and where they go in the container.
+var EtcFiles = map[string]string{
+	"resolv.conf": "/etc/resolv.conf",
+	"hosts":       "/etc/hosts",
+	"hostname":    "/etc/hostname",
+}
+
+// WriteEtcFiles writes resolv.conf, hosts and hostname into dir.
+func WriteEtcFiles(dir string, c EtcConfig) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	hostname := c.Hostname
+	if hostname == "" {
+		h, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		hostname = h
+	}
+
+	resolv, err := resolvConf(c)
+	if err != nil {
+		return err
+	}
+	hosts, err := hostsFile(hostname, c)
+	if err != nil {
+		return err
+	}
+
+	files := map[string]string{
+		"resolv.conf": resolv,
+		"hosts":       hosts,
+		"hostname":    hostname + "\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func resolvConf(c EtcConfig) (string, error) {
+	var servers, search, options []string
+
+	f, err := os.Open(hostResolvConf)
+	if err == nil {
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			fields := strings.Fields(sc.Text())
+			if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			switch fields[0] {
+			case "nameserver":
+				ip := net.ParseIP(fields[1])
+				if ip == nil || (c.OwnNetns && ip.IsLoopback()) {
+					continue
+				}
+				servers = append(servers, fields[1])
+			case "search", "domain":
+				search = fields[1:]
+			case "options":
+				options = append(options, fields[1:]...)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if len(c.DNS) > 0 {
+		servers = nil
+		for _, s := range c.DNS {
+			if net.ParseIP(s) == nil {
+				return "", fmt.Errorf("dns: invalid address %q", s)
+			}
+			servers = append(servers, s)
+		}
+	}
+	if len(servers) == 0 {
+		servers = defaultDNS
+	}
+	if len(c.DNSSearch) > 0 {
+		search = c.DNSSearch
+	}
+
+	var b strings.Builder
+	for _, s := range servers {
+		fmt.Fprintf(&b, "nameserver %s\n", s)
+	}
+	if len(search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(search, " "))
+	}
+	if len(options) > 0 {
+		fmt.Fprintf(&b, "options %s\n", strings.Join(options, " "))
+	}
+	return b.String(), nil
+}
+
+func hostsFile(hostname string, c EtcConfig) (string, error) {
+	var b strings.Builder
+	b.WriteString("127.0.0.1\tlocalhost\n")
+	b.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+	if c.IP != nil {
+		fmt.Fprintf(&b, "%s\t%s\n", c.IP, hostname)
+	} else {
+		fmt.Fprintf(&b, "127.0.1.1\t%s\n", hostname)
+	}
+	for _, h := range c.ExtraHosts {
+		name, ip, ok := strings.Cut(h, ":")
+		if !ok || name == "" || net.ParseIP(ip) == nil {
+			return "", fmt.Errorf("add-host %q: want name:ip", h)
+		}
+		fmt.Fprintf(&b, "%s\t%s\n", ip, name)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,162 @@
+package network
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func withHostResolvConf(t *testing.T, content string) {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := hostResolvConf
+	hostResolvConf = p
+	t.Cleanup(func() { hostResolvConf = old })
+}
+
+func TestResolvConf(t *testing.T) {
+	const host = "# generated\n" +
+		"nameserver 127.0.0.53\n" +
+		"nameserver 192.0.2.1\n" +
+		"nameserver not-an-ip\n" +
+		"search example.com corp.example.com\n" +
+		"options edns0 trust-ad\n"
+	tests := []struct {
+		name    string
+		host    string
+		cfg     EtcConfig
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "host namespace keeps loopback",
+			host: host,
+			want: "nameserver 127.0.0.53\nnameserver 192.0.2.1\n" +
+				"search example.com corp.example.com\noptions edns0 trust-ad\n",
+		},
+		{
+			name: "own namespace drops loopback",
+			host: host,
+			cfg:  EtcConfig{OwnNetns: true},
+			want: "nameserver 192.0.2.1\n" +
+				"search example.com corp.example.com\noptions edns0 trust-ad\n",
+		},
+		{
+			name: "only loopback falls back to defaults",
+			host: "nameserver 127.0.0.53\n",
+			cfg:  EtcConfig{OwnNetns: true},
+			want: "nameserver 8.8.8.8\nnameserver 8.8.4.4\n",
+		},
+		{
+			name: "overrides",
+			host: host,
+			cfg:  EtcConfig{DNS: []string{"1.1.1.1", "2001:db8::1"}, DNSSearch: []string{"svc.local"}},
+			want: "nameserver 1.1.1.1\nnameserver 2001:db8::1\nsearch svc.local\noptions edns0 trust-ad\n",
+		},
+		{
+			name:    "bad dns",
+			host:    host,
+			cfg:     EtcConfig{DNS: []string{"dns.example.com"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withHostResolvConf(t, tt.host)
+			got, err := resolvConf(tt.cfg)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolvConfWithoutHostFile(t *testing.T) {
+	old := hostResolvConf
+	hostResolvConf = filepath.Join(t.TempDir(), "missing")
+	defer func() { hostResolvConf = old }()
+
+	got, err := resolvConf(EtcConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "nameserver 8.8.8.8\nnameserver 8.8.4.4\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestHostsFile(t *testing.T) {
+	const loopback = "127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n"
+	tests := []struct {
+		name    string
+		cfg     EtcConfig
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "no network",
+			want: loopback + "127.0.1.1\tbox\n",
+		},
+		{
+			name: "bridge address and extra hosts",
+			cfg:  EtcConfig{IP: net.ParseIP("10.88.0.2"), ExtraHosts: []string{"db:10.88.0.3", "v6:2001:db8::2"}},
+			want: loopback + "10.88.0.2\tbox\n10.88.0.3\tdb\n2001:db8::2\tv6\n",
+		},
+		{
+			name:    "extra host without ip",
+			cfg:     EtcConfig{ExtraHosts: []string{"db"}},
+			wantErr: true,
+		},
+		{
+			name:    "extra host without name",
+			cfg:     EtcConfig{ExtraHosts: []string{":10.0.0.1"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := hostsFile("box", tt.cfg)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteEtcFiles(t *testing.T) {
+	withHostResolvConf(t, "nameserver 192.0.2.1\n")
+	dir := filepath.Join(t.TempDir(), "etc")
+	if err := WriteEtcFiles(dir, EtcConfig{Hostname: "box", IP: net.ParseIP("10.88.0.2")}); err != nil {
+		t.Fatal(err)
+	}
+	for name := range EtcFiles {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "hostname")); err != nil || string(b) != "box\n" {
+		t.Errorf("hostname: %q, %v", b, err)
+	}
+}
@@ -0,0 +1,139 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// ipamState is the on-disk allocation table, keyed by IP address with
+// the pid of the owning ccrun process as value.
+type ipamState struct {
+	Subnet      string         `json:"subnet"`
+	Allocations map[string]int `json:"allocations"`
+}
+
+func ipamPath(stateDir string) string {
+	return filepath.Join(stateDir, "network", BridgeName+".json")
+}
+
+// withIPAM runs fn with the allocation table loaded and an exclusive
+// lock held, and writes the table back if fn succeeds.
+func withIPAM(stateDir string, fn func(st *ipamState) error) error {
+	p := ipamPath(stateDir)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return fmt.Errorf("ipam: %w", err)
+	}
+	lock, err := os.OpenFile(p+".lock", os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return fmt.Errorf("ipam: %w", err)
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("ipam lock: %w", err)
+	}
+	defer unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+
+	st := &ipamState{Allocations: map[string]int{}}
+	b, err := os.ReadFile(p)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("ipam: %w", err)
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, st); err != nil {
+			return fmt.Errorf("ipam %s: %w", p, err)
+		}
+		if st.Allocations == nil {
+			st.Allocations = map[string]int{}
+		}
+	}
+
+	if err := fn(st); err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, out, 0o644); err != nil {
+		return fmt.Errorf("ipam: %w", err)
+	}
+	return os.Rename(tmp, p)
+}
+
+func alive(pid int) bool {
+	return pid > 0 && unix.Kill(pid, 0) != unix.ESRCH
+}
+
+// allocate reserves a free host address in subnet for owner. The network
+// and gateway (first host) addresses and the broadcast address are never
+// handed out. Allocations held by processes that no longer exist are
+// reclaimed first.
+func allocate(stateDir string, subnet *net.IPNet, owner int) (net.IP, error) {
+	var ip net.IP
+	err := withIPAM(stateDir, func(st *ipamState) error {
+		for a, pid := range st.Allocations {
+			if !alive(pid) {
+				delete(st.Allocations, a)
+			}
+		}
+		if st.Subnet != "" && st.Subnet != subnet.String() && len(st.Allocations) > 0 {
+			return fmt.Errorf("ipam: %s is in use with subnet %s", BridgeName, st.Subnet)
+		}
+		st.Subnet = subnet.String()
+
+		gw := gateway(subnet)
+		bcast := broadcast(subnet)
+		for cand := nextIP(gw); subnet.Contains(cand); cand = nextIP(cand) {
+			if cand.Equal(bcast) {
+				break
+			}
+			if _, used := st.Allocations[cand.String()]; !used {
+				st.Allocations[cand.String()] = owner
+				ip = cand
+				return nil
+			}
+		}
+		return fmt.Errorf("ipam: no free addresses in %s", subnet)
+	})
+	return ip, err
+}
+
+func release(stateDir string, ip net.IP) error {
+	return withIPAM(stateDir, func(st *ipamState) error {
+		delete(st.Allocations, ip.String())
+		return nil
+	})
+}
+
+func nextIP(ip net.IP) net.IP {
+	out := make(net.IP, len(ip))
+	copy(out, ip)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i]++
+		if out[i] != 0 {
+			break
+		}
+	}
+	return out
+}
+
+func gateway(subnet *net.IPNet) net.IP {
+	return nextIP(subnet.IP.Mask(subnet.Mask).To4())
+}
+
+func broadcast(subnet *net.IPNet) net.IP {
+	ip := subnet.IP.Mask(subnet.Mask).To4()
+	out := make(net.IP, len(ip))
+	for i := range ip {
+		out[i] = ip[i] | ^subnet.Mask[len(subnet.Mask)-len(ip)+i]
+	}
+	return out
+}
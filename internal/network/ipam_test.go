@@ -0,0 +1,122 @@
+package network
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func mustSubnet(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// deadPid returns the pid of a process that has already exited.
+func deadPid(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skip("cannot run true:", err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestAllocateSkipsReservedAddresses(t *testing.T) {
+	dir := t.TempDir()
+	subnet := mustSubnet(t, "10.1.2.0/29")
+	me := os.Getpid()
+
+	// .0 is the network, .1 the gateway and .7 the broadcast address
+	var got []string
+	for i := 0; i < 5; i++ {
+		ip, err := allocate(dir, subnet, me)
+		if err != nil {
+			t.Fatalf("allocation %d: %v", i, err)
+		}
+		got = append(got, ip.String())
+	}
+	want := "10.1.2.2 10.1.2.3 10.1.2.4 10.1.2.5 10.1.2.6"
+	if strings.Join(got, " ") != want {
+		t.Errorf("allocated %v, want %s", got, want)
+	}
+	if _, err := allocate(dir, subnet, me); err == nil || !strings.Contains(err.Error(), "no free addresses") {
+		t.Errorf("allocate in a full subnet: %v, want no free addresses", err)
+	}
+}
+
+func TestReleaseFreesAddress(t *testing.T) {
+	dir := t.TempDir()
+	subnet := mustSubnet(t, "10.1.2.0/30")
+	me := os.Getpid()
+
+	ip, err := allocate(dir, subnet, me)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := allocate(dir, subnet, me); err == nil {
+		t.Fatal("second allocation in a /30 succeeded")
+	}
+	if err := release(dir, ip); err != nil {
+		t.Fatal(err)
+	}
+	again, err := allocate(dir, subnet, me)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Equal(ip) {
+		t.Errorf("got %s after release, want %s", again, ip)
+	}
+}
+
+func TestAllocateReclaimsDeadOwners(t *testing.T) {
+	dir := t.TempDir()
+	subnet := mustSubnet(t, "10.1.2.0/30")
+
+	ip, err := allocate(dir, subnet, deadPid(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := allocate(dir, subnet, os.Getpid())
+	if err != nil {
+		t.Fatalf("address of an exited process not reclaimed: %v", err)
+	}
+	if !again.Equal(ip) {
+		t.Errorf("got %s, want the reclaimed %s", again, ip)
+	}
+}
+
+func TestAllocateRejectsOtherSubnetInUse(t *testing.T) {
+	dir := t.TempDir()
+	me := os.Getpid()
+	if _, err := allocate(dir, mustSubnet(t, "10.1.2.0/24"), me); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := allocate(dir, mustSubnet(t, "10.9.0.0/24"), me); err == nil {
+		t.Error("allocated from a second subnet while the first is in use")
+	}
+}
+
+func TestGatewayAndBroadcast(t *testing.T) {
+	tests := []struct {
+		subnet, gateway, broadcast string
+	}{
+		{"10.88.0.0/16", "10.88.0.1", "10.88.255.255"},
+		{"192.168.5.77/24", "192.168.5.1", "192.168.5.255"},
+		{"172.16.0.8/29", "172.16.0.9", "172.16.0.15"},
+	}
+	for _, tt := range tests {
+		n := mustSubnet(t, tt.subnet)
+		if got := gateway(n).String(); got != tt.gateway {
+			t.Errorf("gateway(%s) = %s, want %s", tt.subnet, got, tt.gateway)
+		}
+		if got := broadcast(n).String(); got != tt.broadcast {
+			t.Errorf("broadcast(%s) = %s, want %s", tt.subnet, got, tt.broadcast)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package network
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const natTable = "ccrun"
+
+// ensureNAT enables IPv4 forwarding and installs a masquerade rule for
+// traffic from subnet leaving through any interface other than the bridge.
+// The rule lives in its own nftables table so it never touches rules
+// managed by anything else on the host.
+func ensureNAT(subnet string) error {
+	if err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0o644); err != nil {
+		return fmt.Errorf("enable ip_forward: %w", err)
+	}
+
+	script := strings.Join([]string{
+		"table ip " + natTable + " {",
+		"  chain postrouting { type nat hook postrouting priority srcnat; policy accept; }",
+		"}",
+		"flush chain ip " + natTable + " postrouting",
+		fmt.Sprintf("add rule ip %s postrouting ip saddr %s oifname != %q masquerade", natTable, subnet, BridgeName),
+		"",
+	}, "\n")
+	return nft(script)
+}
+
+func nft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package network
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/alafilearnstocode/ccrun/internal/netlink"
+)
+
+const (
+	BridgeName    = "ccrun0"
+	DefaultSubnet = "10.88.0.0/16"
+
+	// containerIf is the name the veth peer gets inside the container.
+	containerIf = "eth0"
+)
+
+// Endpoint is a container's attachment to the ccrun0 bridge.
+type Endpoint struct {
+	IP      net.IP
+	Subnet  *net.IPNet
+	Gateway net.IP
+
+	stateDir string
+	hostVeth string
+	peerVeth string
+}
+
+// NewEndpoint reserves an address in subnet for the ccrun process owner.
+// Nothing is created on the host until Attach is called.
+func NewEndpoint(stateDir, subnet string, owner int) (*Endpoint, error) {
+	_, sn, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, fmt.Errorf("subnet %q: %w", subnet, err)
+	}
+	if sn.IP.To4() == nil {
+		return nil, fmt.Errorf("subnet %q: only IPv4 is supported", subnet)
+	}
+	if ones, bits := sn.Mask.Size(); bits-ones < 2 {
+		return nil, fmt.Errorf("subnet %q: too small", subnet)
+	}
+	ip, err := allocate(stateDir, sn, owner)
+	if err != nil {
+		return nil, err
+	}
+	return &Endpoint{
+		IP:       ip,
+		Subnet:   sn,
+		Gateway:  gateway(sn),
+		stateDir: stateDir,
+		hostVeth: fmt.Sprintf("ccv%d", owner),
+		peerVeth: fmt.Sprintf("ccp%d", owner),
+	}, nil
+}
+
+// CIDR returns the container address with the subnet prefix length.
+func (e *Endpoint) CIDR() string {
+	return (&net.IPNet{IP: e.IP, Mask: e.Subnet.Mask}).String()
+}
+
+// Attach makes sure the bridge and NAT rules exist, then creates a veth
+// pair with one end on the bridge and the other moved into the network
+// namespace of pid as eth0.
+func (e *Endpoint) Attach(pid int) error {
+	if err := ensureBridge(e.Subnet, e.Gateway); err != nil {
+		return err
+	}
+	if err := ensureNAT(e.Subnet.String()); err != nil {
+		return err
+	}
+	if err := netlink.AddVeth(e.hostVeth, e.peerVeth); err != nil {
+		return err
+	}
+	if err := netlink.SetMaster(e.hostVeth, BridgeName); err != nil {
+		return err
+	}
+	if err := netlink.LinkUp(e.hostVeth); err != nil {
+		return err
+	}
+	return netlink.SetNsPid(e.peerVeth, pid, containerIf)
+}
+
+// Release removes the host end of the veth pair, if it still exists, and
+// returns the address to the pool.
+func (e *Endpoint) Release() error {
+	_ = netlink.LinkDel(e.hostVeth)
+	return release(e.stateDir, e.IP)
+}
+
+func ensureBridge(subnet *net.IPNet, gw net.IP) error {
+	if err := netlink.AddBridge(BridgeName); err != nil {
+		return err
+	}
+	if err := netlink.AddAddr(BridgeName, &net.IPNet{IP: gw, Mask: subnet.Mask}); err != nil {
+		return err
+	}
+	return netlink.LinkUp(BridgeName)
+}
+
+// SetupContainer configures eth0 from inside the container's network
+// namespace once the parent has moved it there.
+func SetupContainer(cidr, gw string) error {
+	ip, sn, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("ip %q: %w", cidr, err)
+	}
+	gwIP := net.ParseIP(gw)
+	if gwIP == nil {
+		return fmt.Errorf("gateway %q: invalid address", gw)
+	}
+	if err := netlink.AddAddr(containerIf, &net.IPNet{IP: ip, Mask: sn.Mask}); err != nil {
+		return err
+	}
+	if err := netlink.LinkUp(containerIf); err != nil {
+		return err
+	}
+	return netlink.AddDefaultRoute(gwIP)
+}
@@ -0,0 +1,255 @@
+package network
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// udpIdleTimeout is how long a UDP flow lives without traffic in either
+// direction. It is a variable for tests.
+var udpIdleTimeout = 90 * time.Second
+
+type PortMapping struct {
+	HostPort      int
+	ContainerPort int
+	Proto         string // "tcp" or "udp"
+}
+
+func (p PortMapping) String() string {
+	return fmt.Sprintf("%d:%d/%s", p.HostPort, p.ContainerPort, p.Proto)
+}
+
+// ParsePortMapping parses hostPort:containerPort[/tcp|udp].
+func ParsePortMapping(s string) (PortMapping, error) {
+	pm := PortMapping{Proto: "tcp"}
+	spec := s
+	if i := strings.LastIndexByte(spec, '/'); i >= 0 {
+		pm.Proto = spec[i+1:]
+		spec = spec[:i]
+	}
+	if pm.Proto != "tcp" && pm.Proto != "udp" {
+		return pm, fmt.Errorf("port %q: unknown protocol %q", s, pm.Proto)
+	}
+	host, ctr, ok := strings.Cut(spec, ":")
+	if !ok {
+		return pm, fmt.Errorf("port %q: want hostPort:containerPort", s)
+	}
+	var err error
+	if pm.HostPort, err = parsePort(host); err != nil {
+		return pm, fmt.Errorf("port %q: %w", s, err)
+	}
+	if pm.ContainerPort, err = parsePort(ctr); err != nil {
+		return pm, fmt.Errorf("port %q: %w", s, err)
+	}
+	return pm, nil
+}
+
+func parsePort(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return n, nil
+}
+
+// Proxy forwards published host ports to a container address. It runs
+// in the ccrun parent process and stops with it.
+type Proxy struct {
+	closers []io.Closer
+	wg      sync.WaitGroup
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{} // open TCP connections, both sides
+	closed bool
+}
+
+// StartProxy binds every host port in maps and forwards traffic to the
+// matching port on ip. If any port cannot be bound, nothing is left
+// listening.
+func StartProxy(ip net.IP, maps []PortMapping) (*Proxy, error) {
+	p := &Proxy{conns: map[net.Conn]struct{}{}}
+	for _, m := range maps {
+		backend := net.JoinHostPort(ip.String(), strconv.Itoa(m.ContainerPort))
+		listen := ":" + strconv.Itoa(m.HostPort)
+		switch m.Proto {
+		case "tcp":
+			l, err := net.Listen("tcp", listen)
+			if err != nil {
+				p.Close()
+				return nil, fmt.Errorf("publish %s: %w", m, err)
+			}
+			p.closers = append(p.closers, l)
+			p.wg.Add(1)
+			go p.serveTCP(l, backend)
+		case "udp":
+			pc, err := net.ListenPacket("udp", listen)
+			if err != nil {
+				p.Close()
+				return nil, fmt.Errorf("publish %s: %w", m, err)
+			}
+			p.closers = append(p.closers, pc)
+			p.wg.Add(1)
+			go p.serveUDP(pc, backend)
+		}
+	}
+	return p, nil
+}
+
+// Close stops listening on all published ports and closes every
+// connection still being forwarded.
+func (p *Proxy) Close() {
+	for _, c := range p.closers {
+		c.Close()
+	}
+	p.mu.Lock()
+	p.closed = true
+	for c := range p.conns {
+		c.Close()
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+// track registers c to be closed by Close. It closes c and returns false
+// if the proxy is already closed.
+func (p *Proxy) track(c net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		c.Close()
+		return false
+	}
+	p.conns[c] = struct{}{}
+	return true
+}
+
+func (p *Proxy) untrack(c net.Conn) {
+	p.mu.Lock()
+	delete(p.conns, c)
+	p.mu.Unlock()
+	c.Close()
+}
+
+func (p *Proxy) serveTCP(l net.Listener, backend string) {
+	defer p.wg.Done()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		if !p.track(c) {
+			return
+		}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			defer p.untrack(c)
+			b, err := net.Dial("tcp", backend)
+			if err != nil {
+				log.Printf("proxy %s: %v", backend, err)
+				return
+			}
+			if !p.track(b) {
+				return
+			}
+			defer p.untrack(b)
+			done := make(chan struct{})
+			go func() {
+				io.Copy(b, c)
+				if tc, ok := b.(*net.TCPConn); ok {
+					tc.CloseWrite()
+				}
+				close(done)
+			}()
+			io.Copy(c, b)
+			if tc, ok := c.(*net.TCPConn); ok {
+				tc.CloseWrite()
+			}
+			<-done
+		}()
+	}
+}
+
+// udpFlow is the backend socket of one UDP client.
+type udpFlow struct {
+	conn net.Conn
+	last time.Time // last traffic either way, guarded by serveUDP's mu
+}
+
+// serveUDP keeps one backend socket per client address so replies can be
+// routed back; flows without traffic either way are dropped after
+// udpIdleTimeout.
+func (p *Proxy) serveUDP(pc net.PacketConn, backend string) {
+	defer p.wg.Done()
+	// mu guards flows and every flow's last use; a flow is only closed
+	// under it, so the read loop never writes to a closed one.
+	var mu sync.Mutex
+	flows := map[string]*udpFlow{}
+	defer func() {
+		mu.Lock()
+		for _, f := range flows {
+			f.conn.Close()
+		}
+		mu.Unlock()
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		key := client.String()
+		mu.Lock()
+		f, ok := flows[key]
+		if !ok {
+			b, err := net.Dial("udp", backend)
+			if err != nil {
+				mu.Unlock()
+				log.Printf("proxy %s: %v", backend, err)
+				continue
+			}
+			f = &udpFlow{conn: b}
+			flows[key] = f
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				rbuf := make([]byte, 65535)
+				for {
+					mu.Lock()
+					deadline := f.last.Add(udpIdleTimeout)
+					mu.Unlock()
+					f.conn.SetReadDeadline(deadline)
+					n, err := f.conn.Read(rbuf)
+					if err != nil {
+						mu.Lock()
+						if ne, ok := err.(net.Error); ok && ne.Timeout() && time.Since(f.last) < udpIdleTimeout {
+							// the client sent something meanwhile
+							mu.Unlock()
+							continue
+						}
+						if flows[key] == f {
+							delete(flows, key)
+						}
+						f.conn.Close()
+						mu.Unlock()
+						return
+					}
+					mu.Lock()
+					f.last = time.Now()
+					mu.Unlock()
+					pc.WriteTo(rbuf[:n], client)
+				}
+			}()
+		}
+		f.last = time.Now()
+		f.conn.Write(buf[:n])
+		mu.Unlock()
+	}
+}
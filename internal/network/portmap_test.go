@@ -0,0 +1,175 @@
+package network
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParsePortMapping(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    PortMapping
+		wantErr bool
+	}{
+		{in: "8080:80", want: PortMapping{8080, 80, "tcp"}},
+		{in: "8080:80/tcp", want: PortMapping{8080, 80, "tcp"}},
+		{in: "5353:53/udp", want: PortMapping{5353, 53, "udp"}},
+		{in: "1:65535", want: PortMapping{1, 65535, "tcp"}},
+		{in: "8080:80/sctp", wantErr: true},
+		{in: "8080", wantErr: true},
+		{in: "0:80", wantErr: true},
+		{in: "8080:65536", wantErr: true},
+		{in: "http:80", wantErr: true},
+		{in: ":80", wantErr: true},
+		{in: "8080:80/", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePortMapping(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParsePortMapping(%q) = %v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParsePortMapping(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParsePortMapping(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// freePort returns a port on which nothing is listening for proto.
+func freePort(t *testing.T, proto string) int {
+	t.Helper()
+	var addr net.Addr
+	switch proto {
+	case "tcp":
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = l.Addr()
+		l.Close()
+	case "udp":
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = pc.LocalAddr()
+		pc.Close()
+	}
+	_, port, _ := net.SplitHostPort(addr.String())
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+func TestProxyUDPOneWayStream(t *testing.T) {
+	defer func(d time.Duration) { udpIdleTimeout = d }(udpIdleTimeout)
+	udpIdleTimeout = 200 * time.Millisecond
+
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	bport := backend.LocalAddr().(*net.UDPAddr).Port
+	hport := freePort(t, "udp")
+	p, err := StartProxy(net.ParseIP("127.0.0.1"), []PortMapping{{hport, bport, "udp"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	client, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(hport)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// the backend never replies; a client that keeps sending for longer
+	// than the idle timeout must not lose packets to the reaper
+	const packets = 20
+	gap := udpIdleTimeout / 10
+	go func() {
+		for i := 0; i < packets; i++ {
+			client.Write([]byte{byte(i)})
+			time.Sleep(gap)
+		}
+	}()
+	buf := make([]byte, 16)
+	var flow string
+	for i := 0; i < packets; i++ {
+		backend.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, from, err := backend.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if n != 1 || buf[0] != byte(i) {
+			t.Fatalf("packet %d: got %v", i, buf[:n])
+		}
+		if flow == "" {
+			flow = from.String()
+		} else if from.String() != flow {
+			t.Fatalf("packet %d came from %s, want the flow %s kept alive", i, from, flow)
+		}
+	}
+}
+
+func TestProxyCloseClosesConnections(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := backend.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+	bport := backend.Addr().(*net.TCPAddr).Port
+	hport := freePort(t, "tcp")
+	p, err := StartProxy(net.ParseIP("127.0.0.1"), []PortMapping{{hport, bport, "tcp"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(hport)))
+	if err != nil {
+		p.Close()
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var b net.Conn
+	select {
+	case b = <-accepted:
+		defer b.Close()
+	case <-time.After(2 * time.Second):
+		p.Close()
+		t.Fatal("connection not forwarded")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close did not return with a connection open")
+	}
+	for _, c := range []net.Conn{client, b} {
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("read after Close: %v, want EOF", err)
+		}
+	}
+}
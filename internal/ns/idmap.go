@@ -0,0 +1,122 @@
+package ns
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// subIDRange is the number of IDs mapped into a user namespace by default,
+// enough for the uids and gids used by common distro images.
+const subIDRange = 65536
+
+// ParseIDMap parses a containerID:hostID:size mapping as used by
+// --uidmap and --gidmap.
+func ParseIDMap(s string) (syscall.SysProcIDMap, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return syscall.SysProcIDMap{}, fmt.Errorf("id map %q: want containerID:hostID:size", s)
+	}
+	var n [3]int
+	for i, p := range parts {
+		v, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return syscall.SysProcIDMap{}, fmt.Errorf("id map %q: %w", s, err)
+		}
+		n[i] = int(v)
+	}
+	if n[2] == 0 {
+		return syscall.SysProcIDMap{}, fmt.Errorf("id map %q: size must be positive", s)
+	}
+	return syscall.SysProcIDMap{ContainerID: n[0], HostID: n[1], Size: n[2]}, nil
+}
+
+// readSubID returns the first range in /etc/subuid or /etc/subgid that
+// belongs to the user, matched by name or numeric id.
+func readSubID(path, name string, id int) (start, count int, ok bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		parts := strings.Split(strings.TrimSpace(sc.Text()), ":")
+		if len(parts) != 3 || (parts[0] != name && parts[0] != strconv.Itoa(id)) {
+			continue
+		}
+		s, err1 := strconv.Atoi(parts[1])
+		c, err2 := strconv.Atoi(parts[2])
+		if err1 != nil || err2 != nil || c <= 0 {
+			continue
+		}
+		return s, c, true
+	}
+	return 0, 0, false
+}
+
+// defaultIDMaps builds the mappings used when --uidmap/--gidmap are not
+// given. Root maps container 0 onto its own subordinate range, if it has
+// one. Other users keep their own id as container root and get their
+// subordinate range from 1 upwards. Without a subordinate range, only the
+// caller's own id is mapped.
+func defaultIDMaps(subidPath string, id int) []syscall.SysProcIDMap {
+	name := ""
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	start, count, ok := readSubID(subidPath, name, id)
+	if count > subIDRange {
+		count = subIDRange
+	}
+	switch {
+	case !ok:
+		return []syscall.SysProcIDMap{{ContainerID: 0, HostID: id, Size: 1}}
+	case id == 0:
+		return []syscall.SysProcIDMap{{ContainerID: 0, HostID: start, Size: count}}
+	case count < 2:
+		return []syscall.SysProcIDMap{{ContainerID: 0, HostID: id, Size: 1}}
+	default:
+		return []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: id, Size: 1},
+			{ContainerID: 1, HostID: start, Size: count - 1},
+		}
+	}
+}
+
+// DefaultIDMaps returns the uid and gid mappings a user namespace gets
+// when none are given explicitly.
+func DefaultIDMaps() (uidMaps, gidMaps []syscall.SysProcIDMap) {
+	return defaultIDMaps("/etc/subuid", os.Getuid()), defaultIDMaps("/etc/subgid", os.Getgid())
+}
+
+// needsHelper reports whether maps can only be installed by the setuid
+// newuidmap/newgidmap helpers: an unprivileged process may only map its
+// own id.
+func needsHelper(maps []syscall.SysProcIDMap, id int) bool {
+	if os.Geteuid() == 0 {
+		return false
+	}
+	return len(maps) != 1 || maps[0].HostID != id || maps[0].Size != 1
+}
+
+// writeIDMapHelper installs maps for pid with newuidmap or newgidmap.
+func writeIDMapHelper(helper string, pid int, maps []syscall.SysProcIDMap) error {
+	path, err := exec.LookPath(helper)
+	if err != nil {
+		return fmt.Errorf("%s is required to map subordinate ids (install the uidmap package or pass explicit single-id maps): %w", helper, err)
+	}
+	args := []string{strconv.Itoa(pid)}
+	for _, m := range maps {
+		args = append(args, strconv.Itoa(m.ContainerID), strconv.Itoa(m.HostID), strconv.Itoa(m.Size))
+	}
+	if out, err := exec.Command(path, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %s", helper, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
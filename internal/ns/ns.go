@@ -5,27 +5,56 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"syscall"
 
 	"github.com/alafilearnstocode/ccrun/internal/cgroup"
+	"github.com/alafilearnstocode/ccrun/internal/idmap"
+	"github.com/alafilearnstocode/ccrun/internal/netlink"
+	"github.com/alafilearnstocode/ccrun/internal/network"
 	"github.com/alafilearnstocode/ccrun/internal/rootfs"
 	"github.com/alafilearnstocode/ccrun/internal/run"
+	"github.com/alafilearnstocode/ccrun/internal/volume"
 	"golang.org/x/sys/unix"
 )
 
 const childSub = "__ccrun_child__"
 
 type Config struct {
-	Hostname string
-	UseUTS   bool
-	Rootfs   string
-	UsePID   bool
-	UseMNT   bool
-	UseUSER  bool
-	MemBytes int64
-	CPUPct   int
-	Workdir  string
-	Env      []string
+	Hostname    string
+	UseUTS      bool
+	Rootfs      string
+	Layers      []string // image layers, bottom first; used instead of Rootfs
+	UsePID      bool
+	UseMNT      bool
+	UseUSER     bool
+	UseNET      bool
+	UseIPC      bool
+	UseCG       bool
+	UseTIME     bool
+	Network     string // "", "none" or "bridge"
+	Subnet      string
+	StateDir    string
+	Ports       []network.PortMapping
+	MemBytes    int64
+	CPUPct      int
+	Workdir     string
+	User        string
+	GroupAdd    []string
+	UIDMaps     []syscall.SysProcIDMap
+	GIDMaps     []syscall.SysProcIDMap
+	Env         []string
+	DNS         []string
+	DNSSearch   []string
+	ExtraHosts  []string
+	TimeOffsets []string
+
+	MaskedPaths   []string
+	ReadonlyPaths []string
+
+	Volumes []rootfs.BindMount
+	Tmpfs   []rootfs.TmpfsMount
 }
 
 func SpawnChild(cfg Config, command string, args []string) (int, error) {
@@ -34,13 +63,137 @@ func SpawnChild(cfg Config, command string, args []string) (int, error) {
 		return 1, err
 	}
 
+	var ep *network.Endpoint
+	if cfg.Network == "bridge" {
+		subnet := cfg.Subnet
+		if subnet == "" {
+			subnet = network.DefaultSubnet
+		}
+		ep, err = network.NewEndpoint(cfg.StateDir, subnet, os.Getpid())
+		if err != nil {
+			return 1, err
+		}
+		defer ep.Release()
+	}
+
+	var uidMaps, gidMaps []syscall.SysProcIDMap
+	var useHelper bool
+	if cfg.UseUSER {
+		uidMaps, gidMaps = cfg.UIDMaps, cfg.GIDMaps
+		if len(uidMaps) == 0 {
+			uidMaps = defaultIDMaps("/etc/subuid", os.Getuid())
+		}
+		if len(gidMaps) == 0 {
+			gidMaps = defaultIDMaps("/etc/subgid", os.Getgid())
+		}
+		useHelper = needsHelper(uidMaps, os.Getuid()) || needsHelper(gidMaps, os.Getgid())
+		// A process only keeps its capabilities across exec in a user
+		// namespace where it is root, which ccrun's helpers and the
+		// child need.
+		if useHelper && idmap.HostID(uidMaps, 0) != os.Getuid() {
+			return 1, fmt.Errorf("uid map: container root must be your own uid %d, not %d", os.Getuid(), idmap.HostID(uidMaps, 0))
+		}
+	}
+
+	// Per-container state: generated etc files and, for images, the
+	// snapshot's upper and work directories and its mount point.
+	var containerDir string
+	if (cfg.Rootfs != "" || len(cfg.Layers) > 0) && cfg.UseMNT {
+		stateDir, err := filepath.Abs(cfg.StateDir)
+		if err != nil {
+			return 1, err
+		}
+		containerDir = filepath.Join(stateDir, "containers", fmt.Sprintf("ccrun-%d", os.Getpid()))
+		// the snapshot's upper directory holds files of the
+		// container's users, which the caller may not remove itself
+		remove := os.RemoveAll
+		if useHelper {
+			remove = Remover(uidMaps, gidMaps)
+		}
+		defer func() {
+			if err := remove(containerDir); err != nil {
+				fmt.Fprintf(os.Stderr, "ccrun: warning: remove %s: %v\n", containerDir, err)
+			}
+		}()
+	}
+
+	var snap *rootfs.Snapshot
+	if len(cfg.Layers) > 0 {
+		if containerDir == "" {
+			return 1, fmt.Errorf("image layers need a mount namespace")
+		}
+		snap, err = newSnapshot(containerDir, cfg.Layers, uidMaps, gidMaps)
+		if err != nil {
+			return 1, err
+		}
+		cfg.Rootfs = filepath.Join(containerDir, "rootfs")
+	}
+
+	volumes := make([]rootfs.BindMount, len(cfg.Volumes))
+	copy(volumes, cfg.Volumes)
+	for i, v := range volumes {
+		if v.Volume == "" {
+			continue
+		}
+		var seedDirs []string
+		switch {
+		case snap != nil:
+			seedDirs, err = snap.Lookup(v.Target)
+		case cfg.Rootfs != "":
+			var dir string
+			dir, err = rootfs.SecureJoin(cfg.Rootfs, v.Target)
+			seedDirs = []string{dir}
+		}
+		if err != nil {
+			return 1, err
+		}
+		vol, err := volume.Acquire(cfg.StateDir, v.Volume, os.Getpid(), volumeSeeder(seedDirs, uidMaps, gidMaps))
+		if err != nil {
+			return 1, err
+		}
+		defer volume.Release(cfg.StateDir, v.Volume, os.Getpid())
+		volumes[i].Source = vol.Mountpoint
+	}
+
+	// Generated resolv.conf, hosts and hostname are bind-mounted over the
+	// image's copies, which describe whatever machine built the image.
+	var etcDir string
+	if containerDir != "" {
+		etcDir = containerDir
+		ec := network.EtcConfig{
+			Hostname:   cfg.Hostname,
+			OwnNetns:   cfg.UseNET,
+			DNS:        cfg.DNS,
+			DNSSearch:  cfg.DNSSearch,
+			ExtraHosts: cfg.ExtraHosts,
+		}
+		if ep != nil {
+			ec.IP = ep.IP
+		}
+		if err := network.WriteEtcFiles(etcDir, ec); err != nil {
+			return 1, err
+		}
+	}
+
 	argv := []string{childSub}
+	if useHelper {
+		// The child is exec'd before newuidmap/newgidmap have mapped it,
+		// and an unmapped process loses its capabilities at exec. It
+		// waits for the maps and execs itself again as container root.
+		argv = append(argv, "-reexec")
+	}
 	if cfg.UseUTS {
 		argv = append(argv, "-uts", "-hostname", cfg.Hostname)
 	}
 	if cfg.Rootfs != "" {
 		argv = append(argv, "-rootfs", cfg.Rootfs)
 	}
+	if snap != nil {
+		for _, l := range snap.Layers {
+			argv = append(argv, "-layer", l)
+		}
+		argv = append(argv, "-upper", snap.Upper, "-work", snap.Work)
+	}
 	if cfg.UsePID {
 		argv = append(argv, "-pidns")
 	}
@@ -50,6 +203,39 @@ func SpawnChild(cfg Config, command string, args []string) (int, error) {
 	if cfg.UseUSER {
 		argv = append(argv, "-userns")
 	}
+	if cfg.UseNET {
+		argv = append(argv, "-netns")
+	}
+	if cfg.UseIPC {
+		argv = append(argv, "-ipcns")
+	}
+	if cfg.UseCG {
+		argv = append(argv, "-cgroupns")
+	}
+	if cfg.UseTIME {
+		argv = append(argv, "-timens")
+	}
+	for _, o := range cfg.TimeOffsets {
+		argv = append(argv, "-time-offset", o)
+	}
+	for _, p := range cfg.MaskedPaths {
+		argv = append(argv, "-mask", p)
+	}
+	for _, p := range cfg.ReadonlyPaths {
+		argv = append(argv, "-readonly", p)
+	}
+	for _, v := range volumes {
+		argv = append(argv, "-volume", v.String())
+	}
+	for _, t := range cfg.Tmpfs {
+		argv = append(argv, "-tmpfs", t.String())
+	}
+	if ep != nil {
+		argv = append(argv, "-ip", ep.CIDR(), "-gw", ep.Gateway.String())
+	}
+	if etcDir != "" {
+		argv = append(argv, "-etc", etcDir)
+	}
 	if cfg.MemBytes > 0 {
 		argv = append(argv, "-mem", fmt.Sprintf("%d", cfg.MemBytes/1024/1024))
 	}
@@ -59,6 +245,12 @@ func SpawnChild(cfg Config, command string, args []string) (int, error) {
 	if cfg.Workdir != "" {
 		argv = append(argv, "-workdir", cfg.Workdir)
 	}
+	if cfg.User != "" {
+		argv = append(argv, "-user", cfg.User)
+	}
+	for _, g := range cfg.GroupAdd {
+		argv = append(argv, "-group-add", g)
+	}
 	for _, e := range cfg.Env {
 		argv = append(argv, "-env", e)
 	}
@@ -78,21 +270,80 @@ func SpawnChild(cfg Config, command string, args []string) (int, error) {
 	if cfg.UseMNT {
 		sp.Cloneflags |= unix.CLONE_NEWNS
 	}
+	if cfg.UseNET {
+		sp.Cloneflags |= unix.CLONE_NEWNET
+	}
+	if cfg.UseIPC {
+		sp.Cloneflags |= unix.CLONE_NEWIPC
+	}
+	if cfg.UseCG {
+		sp.Cloneflags |= unix.CLONE_NEWCGROUP
+	}
 	if cfg.UseUSER {
 		sp.Cloneflags |= unix.CLONE_NEWUSER
 
-		uid := os.Getuid()
-		gid := os.Getgid()
+		// Maps the kernel lets us write ourselves are installed by the
+		// runtime before the child runs; anything wider goes through
+		// newuidmap/newgidmap once the child exists.
+		if !useHelper {
+			sp.UidMappings = uidMaps
+			sp.GidMappings = gidMaps
+			sp.GidMappingsEnableSetgroups = os.Geteuid() == 0
+			sp.Credential = &syscall.Credential{Uid: 0, Gid: 0}
+		}
+	}
+	cmd.SysProcAttr = sp
 
-		sp.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: uid, Size: 1}}
-		sp.GidMappingsEnableSetgroups = false
-		sp.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: gid, Size: 1}}
+	// The child blocks on syncR until the parent has finished the setup
+	// that needs its pid, such as moving a veth into its netns.
+	syncR, syncW, err := os.Pipe()
+	if err != nil {
+		return 1, err
+	}
+	defer syncW.Close()
+	cmd.ExtraFiles = []*os.File{syncR}
 
-		sp.Credential = &syscall.Credential{Uid: 0, Gid: 0}
+	if err := cmd.Start(); err != nil {
+		syncR.Close()
+		return 1, err
 	}
-	cmd.SysProcAttr = sp
+	syncR.Close()
+
+	if useHelper {
+		err := writeIDMapHelper("newuidmap", cmd.Process.Pid, uidMaps)
+		if err == nil {
+			err = writeIDMapHelper("newgidmap", cmd.Process.Pid, gidMaps)
+		}
+		if err != nil {
+			syncW.Close()
+			_ = cmd.Wait()
+			return 1, err
+		}
+	}
+
+	if ep != nil {
+		if err := ep.Attach(cmd.Process.Pid); err != nil {
+			syncW.Close()
+			_ = cmd.Wait()
+			return 1, err
+		}
+		if len(cfg.Ports) > 0 {
+			proxy, err := network.StartProxy(ep.IP, cfg.Ports)
+			if err != nil {
+				syncW.Close()
+				_ = cmd.Wait()
+				return 1, err
+			}
+			defer proxy.Close()
+		}
+	}
+	if _, err := syncW.Write([]byte{0}); err != nil {
+		_ = cmd.Wait()
+		return 1, err
+	}
+	syncW.Close()
 
-	if err := cmd.Run(); err != nil {
+	if err := cmd.Wait(); err != nil {
 		if ee, ok := err.(*exec.ExitError); ok {
 			return ee.ExitCode(), nil
 		}
@@ -117,24 +368,61 @@ func ChildMain() {
 	var useUTS bool
 	var hostname string
 	var root string
+	var layers arrayFlags
+	var upper, work string
 	var usePID bool
 	var useMNT bool
 	var useUSER bool
+	var useNET bool
+	var useIPC bool
+	var useCG bool
+	var useTIME bool
+	var timeOffsets arrayFlags
+	var maskedPaths arrayFlags
+	var readonlyPaths arrayFlags
+	var volumes arrayFlags
+	var tmpfs arrayFlags
+	var ipCIDR string
+	var gateway string
+	var etcDir string
 	var memMB int
 	var cpuPct int
 	var workdir string
+	var user string
+	var groupAdd arrayFlags
 	var envs arrayFlags
+	var reexec bool
+	var synced bool
 
 	f.BoolVar(&useUTS, "uts", false, "use UTS namespace")
 	f.StringVar(&hostname, "hostname", "", "hostname inside container")
-	f.StringVar(&root, "rootfs", "", "path to root filesystem to chroot into")
+	f.StringVar(&root, "rootfs", "", "path to root filesystem to pivot into")
+	f.Var(&layers, "layer", "image layer directory, bottom first (repeatable)")
+	f.StringVar(&upper, "upper", "", "writable snapshot directory on top of the layers")
+	f.StringVar(&work, "work", "", "overlayfs work directory")
 	f.BoolVar(&usePID, "pidns", false, "use PID namespace (isolate process IDs)")
 	f.BoolVar(&useMNT, "mntns", false, "use mount namespace (private mounts)")
 	f.BoolVar(&useUSER, "userns", false, "use user namespace (rootless)")
+	f.BoolVar(&useNET, "netns", false, "use network namespace (loopback only)")
+	f.BoolVar(&useIPC, "ipcns", false, "use IPC namespace (private SysV IPC and mqueue)")
+	f.BoolVar(&useCG, "cgroupns", false, "use cgroup namespace")
+	f.BoolVar(&useTIME, "timens", false, "use time namespace")
+	f.Var(&timeOffsets, "time-offset", "clock=duration offset for the time namespace (repeatable)")
+	f.Var(&maskedPaths, "mask", "path to hide inside the container (repeatable)")
+	f.Var(&readonlyPaths, "readonly", "path to make read-only inside the container (repeatable)")
+	f.Var(&volumes, "volume", "hostPath:containerPath[:ro] bind mount (repeatable)")
+	f.Var(&tmpfs, "tmpfs", "path[:opts] tmpfs mount (repeatable)")
+	f.StringVar(&ipCIDR, "ip", "", "address/prefix for eth0 (bridge network)")
+	f.StringVar(&gateway, "gw", "", "default gateway (bridge network)")
+	f.StringVar(&etcDir, "etc", "", "directory with generated resolv.conf, hosts and hostname")
 	f.IntVar(&memMB, "mem", 0, "memory limit in MB (0 = unlimited)")
 	f.IntVar(&cpuPct, "cpu", 0, "CPU limit in percent (0 or >=100 = unlimited)")
 	f.StringVar(&workdir, "workdir", "", "working directory inside container")
+	f.StringVar(&user, "user", "", "user[:group] to run the command as")
+	f.Var(&groupAdd, "group-add", "supplementary group (repeatable)")
 	f.Var(&envs, "env", "environment variable KEY=VAL (repeatable)")
+	f.BoolVar(&reexec, "reexec", false, "exec again once the parent has written the id maps")
+	f.BoolVar(&synced, "synced", false, "parent setup is already done")
 
 	f.Parse(os.Args[2:])
 	rest := f.Args()
@@ -145,6 +433,11 @@ func ChildMain() {
 	target := rest[0]
 	targs := rest[1:]
 
+	if err := syncWithParent(reexec, synced); err != nil {
+		fmt.Fprintln(os.Stderr, "child:", err)
+		os.Exit(1)
+	}
+
 	if useUTS && hostname != "" {
 		if err := unix.Sethostname([]byte(hostname)); err != nil {
 			fmt.Fprintln(os.Stderr, "sethostname:", err)
@@ -152,40 +445,153 @@ func ChildMain() {
 		}
 	}
 
-	if root != "" {
-		if err := rootfs.EnterChroot(root); err != nil {
-			fmt.Fprintln(os.Stderr, "chroot:", err)
+	if useNET {
+		if err := netlink.LinkUp("lo"); err != nil {
+			fmt.Fprintln(os.Stderr, "netns:", err)
 			os.Exit(1)
 		}
+		if ipCIDR != "" {
+			if err := network.SetupContainer(ipCIDR, gateway); err != nil {
+				fmt.Fprintln(os.Stderr, "network:", err)
+				os.Exit(1)
+			}
+		}
 	}
 
-	if workdir != "" {
-		if err := os.Chdir(workdir); err != nil {
-			fmt.Fprintln(os.Stderr, "chdir:", err)
+	if useMNT {
+		if err := unix.Mount("", "/", "", unix.MS_PRIVATE|unix.MS_REC, ""); err != nil {
+			fmt.Fprintln(os.Stderr, "mount private /:", err)
 			os.Exit(1)
 		}
 	}
 
-	if useMNT {
-		if err := unix.Mount("/", "/", "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
-			fmt.Fprintln(os.Stderr, "bind mount /:", err)
+	if useMNT && len(layers) > 0 {
+		snap := rootfs.Snapshot{Layers: layers, Upper: upper, Work: work}
+		if err := snap.Mount(root, useUSER); err != nil {
+			fmt.Fprintln(os.Stderr, "rootfs:", err)
 			os.Exit(1)
 		}
-		if err := unix.Mount("", "/", "", unix.MS_PRIVATE|unix.MS_REC, ""); err != nil {
-			fmt.Fprintln(os.Stderr, "mount private /:", err)
+	}
+
+	if useTIME {
+		if err := enterTimeNS(timeOffsets); err != nil {
+			fmt.Fprintln(os.Stderr, "timens:", err)
+			os.Exit(1)
+		}
+	}
+
+	if useMNT && root != "" {
+		if err := rootfs.SetupDev(root); err != nil {
+			fmt.Fprintln(os.Stderr, "dev:", err)
 			os.Exit(1)
 		}
 	}
 
+	if useMNT && useIPC {
+		if err := rootfs.Mount(root, "mqueue", "/dev/mqueue", "mqueue", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+			fmt.Fprintln(os.Stderr, "ipcns:", err)
+			os.Exit(1)
+		}
+	}
+
+	if useMNT && root != "" {
+		if err := rootfs.MountSys(root); err != nil {
+			fmt.Fprintln(os.Stderr, "sys:", err)
+			os.Exit(1)
+		}
+	}
+
+	if useMNT && useCG {
+		if err := rootfs.Mount(root, "cgroup2", "/sys/fs/cgroup", "cgroup2", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+			fmt.Fprintln(os.Stderr, "cgroupns:", err)
+			os.Exit(1)
+		}
+	}
+
+	if root != "" && etcDir != "" {
+		for name, target := range network.EtcFiles {
+			if err := rootfs.BindFile(root, filepath.Join(etcDir, name), target); err != nil {
+				fmt.Fprintln(os.Stderr, "etc files:", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	if useMNT && root != "" {
+		for _, v := range volumes {
+			m, err := rootfs.ParseBindMount(v)
+			if err == nil {
+				err = rootfs.Bind(root, m)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+		for _, t := range tmpfs {
+			m, err := rootfs.ParseTmpfsMount(t)
+			if err == nil {
+				err = rootfs.MountTmpfs(root, m)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	// proc has to be mounted before the old root is detached: the kernel
+	// refuses a fresh proc mount in a user namespace that cannot see one.
 	cleanupProc := false
 	if usePID {
-		if err := unix.Mount("proc", "/proc", "proc", 0, ""); err != nil {
+		procDir := "/proc"
+		if root != "" {
+			procDir = filepath.Join(root, "proc")
+			if err := os.MkdirAll(procDir, 0o555); err != nil {
+				fmt.Fprintln(os.Stderr, "mkdir /proc:", err)
+				os.Exit(1)
+			}
+		}
+		if err := unix.Mount("proc", procDir, "proc", 0, ""); err != nil {
 			fmt.Fprintln(os.Stderr, "mount /proc:", err)
 			os.Exit(1)
 		}
 		cleanupProc = true
 	}
 
+	if root != "" {
+		if useMNT {
+			if err := rootfs.PivotRoot(root); err != nil {
+				fmt.Fprintln(os.Stderr, "pivot_root:", err)
+				os.Exit(1)
+			}
+			if err := rootfs.MaskPaths(maskedPaths); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			if err := rootfs.ReadonlyPaths(readonlyPaths); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		} else {
+			if err := rootfs.EnterChroot(root); err != nil {
+				fmt.Fprintln(os.Stderr, "chroot:", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	if workdir != "" {
+		if root != "" {
+			// images may name a WORKDIR that no layer creates
+			_ = os.MkdirAll(workdir, 0o755)
+		}
+		if err := os.Chdir(workdir); err != nil {
+			fmt.Fprintln(os.Stderr, "chdir:", err)
+			os.Exit(1)
+		}
+	}
+
 	var cgPath string
 	if memMB > 0 || cpuPct > 0 {
 		memBytes := int64(memMB) * 1024 * 1024
@@ -197,10 +603,37 @@ func ChildMain() {
 		cgPath = p
 	}
 
-	env := os.Environ()
-	env = append(env, envs...)
+	// In an image or rootfs, the target's environment is the image's Env
+	// overridden by --env, which the caller merged in that order, plus
+	// defaults for what they leave out; nothing of ccrun's own
+	// environment is passed on. On the host filesystem the target
+	// inherits ccrun's environment, as it does without namespaces.
+	var cred *syscall.Credential
+	c, home, err := resolveUser(user, groupAdd)
+	switch {
+	case user != "" || len(groupAdd) > 0:
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		cred = c
+	case err != nil:
+		// only HOME depends on it
+		home = "/"
+	}
+	var env []string
+	if root != "" {
+		_, ttyErr := unix.IoctlGetTermios(0, unix.TCGETS)
+		env = targetEnv(envs, home, ttyErr == nil)
+	} else {
+		env = os.Environ()
+		if cred != nil {
+			env = append(env, "HOME="+home)
+		}
+		env = append(env, envs...)
+	}
 
-	code, err := run.ExecPassthrough(target, targs, env)
+	code, err := run.ExecAs(target, targs, env, cred)
 
 	if cleanupProc {
 		_ = unix.Unmount("/proc", 0)
@@ -209,8 +642,66 @@ func ChildMain() {
 		cgroup.Cleanup(cgPath)
 	}
 
-	if err != nil && code == 0 {
-		code = 1
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "exec:", err)
+		if code == 0 {
+			code = 1
+		}
 	}
 	os.Exit(code)
 }
+
+// syncWithParent blocks on the sync pipe, fd 3, until the parent has
+// finished the setup that needs the child's pid. If the parent had
+// newuidmap and newgidmap map the child (reexec), the child then execs
+// itself again in place: it was exec'd unmapped and so without
+// capabilities, and only gets root's once it is root in its user
+// namespace. The new image, started with -synced, skips both steps.
+func syncWithParent(reexec, synced bool) error {
+	if synced {
+		return nil
+	}
+	syncPipe := os.NewFile(3, "sync")
+	if _, err := syncPipe.Read(make([]byte, 1)); err != nil {
+		return fmt.Errorf("parent setup failed")
+	}
+	syncPipe.Close()
+	if !reexec {
+		return nil
+	}
+	if unix.Geteuid() != 0 {
+		return fmt.Errorf("the uid map does not make the caller root in the user namespace")
+	}
+	// the parent puts -reexec right after the subcommand
+	argv := append([]string{}, os.Args...)
+	argv[2] = "-synced"
+	return unix.Exec("/proc/self/exe", argv, os.Environ())
+}
+
+// defaultPath is the PATH of targets whose image does not set one, as
+// in docker.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// targetEnv completes env with HOME, PATH and, on a terminal, TERM,
+// unless env already sets them.
+func targetEnv(env []string, home string, tty bool) []string {
+	env = append([]string{}, env...)
+	has := func(key string) bool {
+		for _, e := range env {
+			if strings.HasPrefix(e, key+"=") {
+				return true
+			}
+		}
+		return false
+	}
+	if !has("HOME") {
+		env = append(env, "HOME="+home)
+	}
+	if !has("PATH") {
+		env = append(env, "PATH="+defaultPath)
+	}
+	if !has("TERM") && tty {
+		env = append(env, "TERM=xterm")
+	}
+	return env
+}
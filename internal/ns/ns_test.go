@@ -0,0 +1,203 @@
+package ns
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/alafilearnstocode/ccrun/internal/idmap"
+	"github.com/alafilearnstocode/ccrun/internal/registry"
+	"github.com/alafilearnstocode/ccrun/internal/volume"
+)
+
+// helperMaps returns the default id maps if they can only be installed
+// with newuidmap and newgidmap, and skips the test otherwise.
+func helperMaps(t *testing.T) (uidMaps, gidMaps []syscall.SysProcIDMap) {
+	t.Helper()
+	if os.Geteuid() == 0 {
+		t.Skip("needs an unprivileged user")
+	}
+	for _, helper := range []string{"newuidmap", "newgidmap"} {
+		if _, err := exec.LookPath(helper); err != nil {
+			t.Skipf("%s not installed", helper)
+		}
+	}
+	uidMaps, gidMaps = DefaultIDMaps()
+	if !needsHelper(uidMaps, os.Getuid()) || !needsHelper(gidMaps, os.Getgid()) {
+		t.Skip("no subordinate id ranges for this user")
+	}
+	return uidMaps, gidMaps
+}
+
+func TestSpawnChildHelperMaps(t *testing.T) {
+	helperMaps(t)
+
+	// The child mounts a fresh /proc for its pid namespace, where it is
+	// pid 1; an unmapped child has no capabilities and cannot.
+	cfg := Config{UsePID: true, UseMNT: true, UseUSER: true}
+	code, err := SpawnChild(cfg, "grep", []string{"-qa", childSub, "/proc/1/cmdline"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 0 {
+		t.Fatalf("child exited with %d", code)
+	}
+}
+
+// unpackTestLayer unpacks a layer of hdrs, without file contents, into a
+// new directory with LayerUnpacker.
+func unpackTestLayer(t *testing.T, uidMaps, gidMaps []syscall.SysProcIDMap, hdrs ...*tar.Header) string {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range hdrs {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	blobs := registry.NewBlobStore(filepath.Join(t.TempDir(), "blobs"))
+	digest, err := blobs.PutBytes(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unpack := LayerUnpacker(blobs, uidMaps, gidMaps)
+	if unpack == nil {
+		t.Fatal("no unpacker for maps that need newuidmap")
+	}
+	dir := t.TempDir()
+	l := registry.Layer{MediaType: "application/vnd.oci.image.layer.v1.tar", Digest: digest}
+	if err := unpack(l, digest, dir); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestLayerUnpackerShiftsOwners(t *testing.T) {
+	uidMaps, gidMaps := helperMaps(t)
+
+	dir := unpackTestLayer(t, uidMaps, gidMaps,
+		&tar.Header{Name: "root", Typeflag: tar.TypeReg, Mode: 0o644},
+		&tar.Header{Name: "user", Typeflag: tar.TypeReg, Mode: 0o644, Uid: 1000, Gid: 1000},
+	)
+	for name, id := range map[string]int{"root": 0, "user": 1000} {
+		var st syscall.Stat_t
+		if err := syscall.Lstat(filepath.Join(dir, name), &st); err != nil {
+			t.Fatal(err)
+		}
+		uid, gid := idmap.HostID(uidMaps, id), idmap.HostID(gidMaps, id)
+		if int(st.Uid) != uid || int(st.Gid) != gid {
+			t.Errorf("%s: owned by %d:%d, want %d:%d", name, st.Uid, st.Gid, uid, gid)
+		}
+	}
+}
+
+func TestRemoverHelper(t *testing.T) {
+	uidMaps, gidMaps := helperMaps(t)
+
+	// a directory of a container user, which the caller cannot empty
+	dir := unpackTestLayer(t, uidMaps, gidMaps,
+		&tar.Header{Name: "home/", Typeflag: tar.TypeDir, Mode: 0o755, Uid: 1000, Gid: 1000},
+		&tar.Header{Name: "home/f", Typeflag: tar.TypeReg, Mode: 0o644, Uid: 1000, Gid: 1000},
+	)
+	if err := Remover(uidMaps, gidMaps)(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(dir); !os.IsNotExist(err) {
+		t.Errorf("%s not removed: %v", dir, err)
+	}
+	if err := Remover(uidMaps, gidMaps)(dir); err != nil {
+		t.Errorf("removing a missing directory: %v", err)
+	}
+}
+
+func TestVolumeSeederHelper(t *testing.T) {
+	uidMaps, gidMaps := helperMaps(t)
+
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "f"), []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := volumeSeeder([]string{src}, uidMaps, gidMaps)(dir); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "f")); err != nil || string(b) != "data" {
+		t.Errorf("f: %q, %v", b, err)
+	}
+}
+
+func TestVolumeRemoveHelper(t *testing.T) {
+	uidMaps, gidMaps := helperMaps(t)
+
+	// an image directory of a container user, seeded into the volume
+	// with its subordinate owner
+	src := unpackTestLayer(t, uidMaps, gidMaps,
+		&tar.Header{Name: "home/", Typeflag: tar.TypeDir, Mode: 0o755, Uid: 1000, Gid: 1000},
+		&tar.Header{Name: "home/f", Typeflag: tar.TypeReg, Mode: 0o644, Uid: 1000, Gid: 1000},
+	)
+	state := t.TempDir()
+	if _, err := volume.Acquire(state, "data", os.Getpid(), volumeSeeder([]string{src}, uidMaps, gidMaps)); err != nil {
+		t.Fatal(err)
+	}
+	if err := volume.Release(state, "data", os.Getpid()); err != nil {
+		t.Fatal(err)
+	}
+	if err := volume.Remove(state, "data", false, Remover(uidMaps, gidMaps)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := volume.Inspect(state, "data"); err == nil {
+		t.Error("volume still there after Remove")
+	}
+	if err := Remover(uidMaps, gidMaps)(src); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewSnapshotForOtherRootGroup(t *testing.T) {
+	uidMaps, gidMaps := helperMaps(t)
+
+	// container root's group is a subordinate gid, which the caller
+	// cannot chown to
+	sub := idmap.HostID(gidMaps, 1)
+	gidMaps = []syscall.SysProcIDMap{{ContainerID: 0, HostID: sub, Size: 1}, {ContainerID: 1, HostID: os.Getgid(), Size: 1}}
+
+	layer := t.TempDir()
+	if err := os.Chmod(layer, 0o750); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "ccrun-1")
+	snap, err := newSnapshot(dir, []string{layer}, uidMaps, gidMaps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{snap.Upper, snap.Work, filepath.Join(dir, "rootfs")} {
+		var st syscall.Stat_t
+		if err := syscall.Lstat(d, &st); err != nil {
+			t.Fatal(err)
+		}
+		if int(st.Uid) != os.Getuid() || int(st.Gid) != sub {
+			t.Errorf("%s: owned by %d:%d, want %d:%d", d, st.Uid, st.Gid, os.Getuid(), sub)
+		}
+	}
+	if fi, err := os.Stat(snap.Upper); err != nil || fi.Mode().Perm() != 0o750 {
+		t.Errorf("upper: %v, %v; want the top layer's mode 0750", fi.Mode(), err)
+	}
+}
+
+func TestSpawnChildRejectsOtherRoot(t *testing.T) {
+	uidMaps, _ := helperMaps(t)
+
+	cfg := Config{UseUSER: true, UIDMaps: []syscall.SysProcIDMap{{ContainerID: 0, HostID: idmap.HostID(uidMaps, 1), Size: 1}}}
+	if _, err := SpawnChild(cfg, "true", nil); err == nil || !strings.Contains(err.Error(), "container root") {
+		t.Errorf("got %v, want an error about container root", err)
+	}
+}
@@ -0,0 +1,53 @@
+package ns
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+const removeSub = "__ccrun_remove__"
+
+// Remover returns a function that removes a directory tree, such as a
+// container's snapshot or a volume's data, whose files may belong to the
+// host ids of uidMaps and gidMaps. Callers that may not remove files of
+// those ids themselves remove the tree in a user namespace with the
+// maps, like LayerUnpacker.
+func Remover(uidMaps, gidMaps []syscall.SysProcIDMap) func(dir string) error {
+	if !needsHelper(uidMaps, os.Getuid()) && !needsHelper(gidMaps, os.Getgid()) {
+		return os.RemoveAll
+	}
+	return func(dir string) error {
+		if _, err := os.Lstat(dir); errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return runMapped([]string{removeSub, "-reexec", "--", dir}, uidMaps, gidMaps)
+	}
+}
+
+// RemoveMain is the helper started by Remover. It removes one directory
+// tree as root of the user namespace.
+func RemoveMain() {
+	f := flag.NewFlagSet(removeSub, flag.ExitOnError)
+	var reexec, synced bool
+	f.BoolVar(&reexec, "reexec", false, "exec again once the parent has written the id maps")
+	f.BoolVar(&synced, "synced", false, "parent setup is already done")
+
+	f.Parse(os.Args[2:])
+	if f.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "remove: missing <dir>")
+		os.Exit(2)
+	}
+
+	if err := syncWithParent(reexec, synced); err != nil {
+		fmt.Fprintln(os.Stderr, "remove:", err)
+		os.Exit(1)
+	}
+	if err := os.RemoveAll(f.Arg(0)); err != nil {
+		fmt.Fprintln(os.Stderr, "remove:", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,55 @@
+package ns
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/alafilearnstocode/ccrun/internal/idmap"
+	"github.com/alafilearnstocode/ccrun/internal/volume"
+)
+
+const seedSub = "__ccrun_seed__"
+
+// volumeSeeder returns the seed function for volume.Acquire that
+// prepares a volume for a container with uidMaps and gidMaps from
+// seedDirs; see volume.Seed. Callers that may not give files to the host
+// ids of the maps seed in a user namespace with them, like
+// LayerUnpacker.
+func volumeSeeder(seedDirs []string, uidMaps, gidMaps []syscall.SysProcIDMap) func(string) error {
+	if !needsHelper(uidMaps, os.Getuid()) && !needsHelper(gidMaps, os.Getgid()) {
+		return func(dir string) error {
+			return volume.Seed(dir, seedDirs, idmap.HostID(uidMaps, 0), idmap.HostID(gidMaps, 0))
+		}
+	}
+	return func(dir string) error {
+		return runMapped(append([]string{seedSub, "-reexec", "--", dir}, seedDirs...), uidMaps, gidMaps)
+	}
+}
+
+// SeedMain is the helper started by volumeSeeder. As root of the user
+// namespace, it gives the volume to root and copies the image's files
+// with the owners they have there.
+func SeedMain() {
+	f := flag.NewFlagSet(seedSub, flag.ExitOnError)
+	var reexec, synced bool
+	f.BoolVar(&reexec, "reexec", false, "exec again once the parent has written the id maps")
+	f.BoolVar(&synced, "synced", false, "parent setup is already done")
+
+	f.Parse(os.Args[2:])
+	if f.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "seed: want <dir> [<seed dir>...]")
+		os.Exit(2)
+	}
+
+	if err := syncWithParent(reexec, synced); err != nil {
+		fmt.Fprintln(os.Stderr, "seed:", err)
+		os.Exit(1)
+	}
+	if err := volume.Seed(f.Arg(0), f.Args()[1:], 0, 0); err != nil {
+		fmt.Fprintln(os.Stderr, "seed:", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
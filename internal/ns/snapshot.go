@@ -0,0 +1,87 @@
+package ns
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/alafilearnstocode/ccrun/internal/idmap"
+	"github.com/alafilearnstocode/ccrun/internal/rootfs"
+)
+
+const snapshotSub = "__ccrun_snapshot__"
+
+// newSnapshot creates the writable directories of a container's snapshot
+// of layers in dir. They belong to the container's root user, so that
+// root in the container can write to its own root directory. Callers
+// that may not give files to that user create them in a user namespace
+// with uidMaps and gidMaps, like LayerUnpacker.
+func newSnapshot(dir string, layers []string, uidMaps, gidMaps []syscall.SysProcIDMap) (*rootfs.Snapshot, error) {
+	snap := &rootfs.Snapshot{
+		Layers: layers,
+		Upper:  filepath.Join(dir, "upper"),
+		Work:   filepath.Join(dir, "work"),
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	top := layers[len(layers)-1]
+	uid, gid := idmap.HostID(uidMaps, 0), idmap.HostID(gidMaps, 0)
+	if os.Geteuid() != 0 && (uid != os.Getuid() || gid != os.Getgid()) {
+		if err := runMapped([]string{snapshotSub, "-reexec", "--", dir, top}, uidMaps, gidMaps); err != nil {
+			return nil, err
+		}
+		return snap, nil
+	}
+	if err := makeSnapshotDirs(dir, top, uid, gid); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// makeSnapshotDirs creates the upper, work and rootfs directories in dir
+// for uid and gid.
+func makeSnapshotDirs(dir, top string, uid, gid int) error {
+	// the merged root takes its mode from the upper directory
+	mode := os.FileMode(0o755)
+	if fi, err := os.Stat(top); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	for _, name := range []string{"upper", "work", "rootfs"} {
+		d := filepath.Join(dir, name)
+		if err := os.Mkdir(d, 0o700); err != nil {
+			return err
+		}
+		if err := os.Chown(d, uid, gid); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(filepath.Join(dir, "upper"), mode)
+}
+
+// SnapshotMain is the helper started by newSnapshot. It creates the
+// snapshot's directories as root of the user namespace.
+func SnapshotMain() {
+	f := flag.NewFlagSet(snapshotSub, flag.ExitOnError)
+	var reexec, synced bool
+	f.BoolVar(&reexec, "reexec", false, "exec again once the parent has written the id maps")
+	f.BoolVar(&synced, "synced", false, "parent setup is already done")
+
+	f.Parse(os.Args[2:])
+	if f.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "snapshot: want <dir> <top layer>")
+		os.Exit(2)
+	}
+
+	if err := syncWithParent(reexec, synced); err != nil {
+		fmt.Fprintln(os.Stderr, "snapshot:", err)
+		os.Exit(1)
+	}
+	if err := makeSnapshotDirs(f.Arg(0), f.Arg(1), 0, 0); err != nil {
+		fmt.Fprintln(os.Stderr, "snapshot:", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
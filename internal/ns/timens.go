@@ -0,0 +1,68 @@
+package ns
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ParseTimeOffset parses clock=duration (e.g. monotonic=-1h or
+// boottime=720h) into a line for /proc/self/timens_offsets.
+func ParseTimeOffset(s string) (string, error) {
+	clock, val, ok := strings.Cut(s, "=")
+	if !ok {
+		return "", fmt.Errorf("time offset %q: want clock=duration", s)
+	}
+	if clock != "monotonic" && clock != "boottime" {
+		return "", fmt.Errorf("time offset %q: clock must be monotonic or boottime", s)
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return "", fmt.Errorf("time offset %q: %w", s, err)
+	}
+	secs := int64(d / time.Second)
+	nsecs := int64(d % time.Second)
+	if nsecs < 0 {
+		secs--
+		nsecs += int64(time.Second)
+	}
+	return fmt.Sprintf("%s %d %d", clock, secs, nsecs), nil
+}
+
+// enterTimeNS unshares a time namespace and sets its offsets. Like PID
+// namespaces, it only applies to children, so the target command started
+// afterwards is the first process inside it. Only children of the
+// calling thread are affected, so the goroutine stays locked to that
+// thread for good and must be the one that starts the target.
+//
+// The namespace cannot be requested with the clone flags instead: a
+// child created in a time namespace freezes its offsets before the
+// parent could write them.
+func enterTimeNS(offsets []string) error {
+	runtime.LockOSThread()
+	if err := unix.Unshare(unix.CLONE_NEWTIME); err != nil {
+		return fmt.Errorf("unshare: %w", err)
+	}
+	var lines []string
+	for _, o := range offsets {
+		l, err := ParseTimeOffset(o)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, l)
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	// /proc/self would be the main thread, which may not be this one;
+	// /proc/<tid> is this thread, and unlike /proc/thread-self it has
+	// the file
+	if err := os.WriteFile(fmt.Sprintf("/proc/%d/timens_offsets", unix.Gettid()), []byte(strings.Join(lines, "\n")), 0o644); err != nil {
+		return fmt.Errorf("timens_offsets: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package ns
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMain(m *testing.M) {
+	// re-executed by SpawnChild as the container's init and by
+	// LayerUnpacker, volumeSeeder, Remover and newSnapshot as their
+	// helpers
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case childSub:
+			ChildMain()
+		case unpackSub:
+			UnpackMain()
+		case seedSub:
+			SeedMain()
+		case removeSub:
+			RemoveMain()
+		case snapshotSub:
+			SnapshotMain()
+		}
+	}
+	// re-executed by TestTimeNSOffset to report its clock
+	if os.Getenv("CCRUN_TEST_PRINT_MONOTONIC") == "1" {
+		var ts unix.Timespec
+		unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts)
+		os.Stdout.WriteString(strconv.FormatInt(ts.Sec, 10))
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestTimeNSOffset(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+	offset := 240 * time.Hour
+
+	type result struct {
+		secs int64
+		err  error
+	}
+	ch := make(chan result)
+	// the goroutine's thread stays locked in the new namespace and is
+	// discarded when the goroutine returns
+	go func() {
+		if err := enterTimeNS([]string{"monotonic=" + offset.String()}); err != nil {
+			ch <- result{err: err}
+			return
+		}
+		// give the scheduler every chance to move us
+		for i := 0; i < 100; i++ {
+			runtime.Gosched()
+		}
+		cmd := exec.Command(os.Args[0], "-test.run=^$")
+		cmd.Env = append(os.Environ(), "CCRUN_TEST_PRINT_MONOTONIC=1")
+		out, err := cmd.Output()
+		if err != nil {
+			ch <- result{err: err}
+			return
+		}
+		secs, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+		ch <- result{secs, err}
+	}()
+	r := <-ch
+	if r.err != nil {
+		if strings.Contains(r.err.Error(), "unshare") {
+			t.Skipf("no time namespaces: %v", r.err)
+		}
+		t.Fatal(r.err)
+	}
+
+	var host unix.Timespec
+	unix.ClockGettime(unix.CLOCK_MONOTONIC, &host)
+	if got, want := r.secs, host.Sec+int64(offset/time.Second); got < want-60 || got > want {
+		t.Errorf("child CLOCK_MONOTONIC = %ds, want about %ds (host %ds + %v)", got, want, host.Sec, offset)
+	}
+}
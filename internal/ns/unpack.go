@@ -0,0 +1,153 @@
+package ns
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/alafilearnstocode/ccrun/internal/registry"
+	"golang.org/x/sys/unix"
+)
+
+const unpackSub = "__ccrun_unpack__"
+
+// LayerUnpacker returns a registry.PullOptions.Unpack for callers that
+// may not give files to the host ids of uidMaps and gidMaps themselves:
+// it unpacks every layer in a user namespace with those maps, where the
+// kernel shifts the owners. It returns nil if this process can unpack
+// layers for the maps on its own.
+func LayerUnpacker(blobs *registry.BlobStore, uidMaps, gidMaps []syscall.SysProcIDMap) func(registry.Layer, string, string) error {
+	if !needsHelper(uidMaps, os.Getuid()) && !needsHelper(gidMaps, os.Getgid()) {
+		return nil
+	}
+	return func(l registry.Layer, diffID, dir string) error {
+		argv := []string{unpackSub, "-reexec",
+			"-blobs", blobs.Root(),
+			"-media-type", l.MediaType,
+			"-digest", l.Digest,
+			"-diff-id", diffID,
+		}
+		for _, m := range uidMaps {
+			argv = append(argv, "-uidmap", formatIDMap(m))
+		}
+		for _, m := range gidMaps {
+			argv = append(argv, "-gidmap", formatIDMap(m))
+		}
+		argv = append(argv, "--", dir)
+		return runMapped(argv, uidMaps, gidMaps)
+	}
+}
+
+// runMapped runs ccrun with argv in a new user namespace whose maps are
+// installed by newuidmap and newgidmap. The error output of a failed
+// run is returned as its error.
+func runMapped(argv []string, uidMaps, gidMaps []syscall.SysProcIDMap) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(self, argv...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: unix.CLONE_NEWUSER}
+
+	syncR, syncW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer syncW.Close()
+	cmd.ExtraFiles = []*os.File{syncR}
+	if err := cmd.Start(); err != nil {
+		syncR.Close()
+		return err
+	}
+	syncR.Close()
+
+	err = writeIDMapHelper("newuidmap", cmd.Process.Pid, uidMaps)
+	if err == nil {
+		err = writeIDMapHelper("newgidmap", cmd.Process.Pid, gidMaps)
+	}
+	if err == nil {
+		_, err = syncW.Write([]byte{0})
+	}
+	syncW.Close()
+	if err != nil {
+		_ = cmd.Wait()
+		return err
+	}
+	if err := cmd.Wait(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return errors.New(msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// UnpackMain is the helper started by LayerUnpacker. It unpacks one
+// layer as root of the user namespace.
+func UnpackMain() {
+	f := flag.NewFlagSet(unpackSub, flag.ExitOnError)
+	var reexec, synced bool
+	var blobs, mediaType, digest, diffID string
+	var uidMaps, gidMaps arrayFlags
+
+	f.BoolVar(&reexec, "reexec", false, "exec again once the parent has written the id maps")
+	f.BoolVar(&synced, "synced", false, "parent setup is already done")
+	f.StringVar(&blobs, "blobs", "", "blob store directory")
+	f.StringVar(&mediaType, "media-type", "", "media type of the layer")
+	f.StringVar(&digest, "digest", "", "digest of the layer blob")
+	f.StringVar(&diffID, "diff-id", "", "digest of the uncompressed layer")
+	f.Var(&uidMaps, "uidmap", "uid mapping of the user namespace (repeatable)")
+	f.Var(&gidMaps, "gidmap", "gid mapping of the user namespace (repeatable)")
+
+	f.Parse(os.Args[2:])
+	if f.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "unpack: missing <dir>")
+		os.Exit(2)
+	}
+
+	if err := syncWithParent(reexec, synced); err != nil {
+		fmt.Fprintln(os.Stderr, "unpack:", err)
+		os.Exit(1)
+	}
+
+	// In here the kernel does the shifting: every mapped id is given to
+	// files as it is, and only unmapped ones are changed.
+	opts := registry.PullOptions{Blobs: registry.NewBlobStore(blobs)}
+	var err error
+	if opts.UIDMap, err = insideMaps(uidMaps); err == nil {
+		opts.GIDMap, err = insideMaps(gidMaps)
+	}
+	if err == nil {
+		err = registry.UnpackLayer(registry.Layer{MediaType: mediaType, Digest: digest}, diffID, f.Arg(0), opts)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "unpack:", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func formatIDMap(m syscall.SysProcIDMap) string {
+	return fmt.Sprintf("%d:%d:%d", m.ContainerID, m.HostID, m.Size)
+}
+
+// insideMaps parses id maps and returns them as seen from inside their
+// user namespace, where every mapped id stands for itself.
+func insideMaps(specs []string) ([]syscall.SysProcIDMap, error) {
+	var maps []syscall.SysProcIDMap
+	for _, s := range specs {
+		m, err := ParseIDMap(s)
+		if err != nil {
+			return nil, err
+		}
+		m.HostID = m.ContainerID
+		maps = append(maps, m)
+	}
+	return maps, nil
+}
@@ -0,0 +1,188 @@
+package ns
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// passwdEntry and groupEntry are the fields of /etc/passwd and /etc/group
+// that matter for setting up the target's identity.
+type passwdEntry struct {
+	name     string
+	uid, gid uint32
+	home     string
+}
+
+type groupEntry struct {
+	name    string
+	gid     uint32
+	members []string
+}
+
+// readColonFile calls fn with the fields of every non-comment line of an
+// /etc/passwd-style file. A missing file is treated as empty: minimal
+// images often have neither /etc/passwd nor /etc/group.
+func readColonFile(path string, fn func(fields []string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fn(strings.Split(line, ":"))
+	}
+	return sc.Err()
+}
+
+func readPasswd() ([]passwdEntry, error) {
+	var out []passwdEntry
+	err := readColonFile("/etc/passwd", func(f []string) {
+		if len(f) < 6 {
+			return
+		}
+		uid, err1 := strconv.ParseUint(f[2], 10, 32)
+		gid, err2 := strconv.ParseUint(f[3], 10, 32)
+		if err1 != nil || err2 != nil {
+			return
+		}
+		out = append(out, passwdEntry{name: f[0], uid: uint32(uid), gid: uint32(gid), home: f[5]})
+	})
+	return out, err
+}
+
+func readGroup() ([]groupEntry, error) {
+	var out []groupEntry
+	err := readColonFile("/etc/group", func(f []string) {
+		if len(f) < 3 {
+			return
+		}
+		gid, err := strconv.ParseUint(f[2], 10, 32)
+		if err != nil {
+			return
+		}
+		g := groupEntry{name: f[0], gid: uint32(gid)}
+		if len(f) > 3 && f[3] != "" {
+			g.members = strings.Split(f[3], ",")
+		}
+		out = append(out, g)
+	})
+	return out, err
+}
+
+func lookupGroup(groups []groupEntry, spec string) (uint32, error) {
+	if n, err := strconv.ParseUint(spec, 10, 32); err == nil {
+		return uint32(n), nil
+	}
+	for _, g := range groups {
+		if g.name == spec {
+			return g.gid, nil
+		}
+	}
+	return 0, fmt.Errorf("group %q: not found in /etc/group", spec)
+}
+
+// resolveUser turns a user[:group] spec plus extra groups into the
+// credential the target command runs with, and returns the user's home
+// directory. Names are looked up in the container's /etc/passwd and
+// /etc/group, so this must run after the root switch.
+func resolveUser(spec string, groupAdd []string) (*syscall.Credential, string, error) {
+	passwd, err := readPasswd()
+	if err != nil {
+		return nil, "", err
+	}
+	groups, err := readGroup()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if spec == "" {
+		spec = "0"
+	}
+	u, g, hasGroup := strings.Cut(spec, ":")
+
+	var pw *passwdEntry
+	if n, err := strconv.ParseUint(u, 10, 32); err == nil {
+		for i := range passwd {
+			if passwd[i].uid == uint32(n) {
+				pw = &passwd[i]
+				break
+			}
+		}
+		if pw == nil {
+			// numeric ids need not exist in the image; like docker,
+			// they get group 0 unless one is given
+			pw = &passwdEntry{uid: uint32(n), gid: 0, home: "/"}
+		}
+	} else {
+		for i := range passwd {
+			if passwd[i].name == u {
+				pw = &passwd[i]
+				break
+			}
+		}
+		if pw == nil {
+			return nil, "", fmt.Errorf("user %q: not found in /etc/passwd", u)
+		}
+	}
+
+	cred := &syscall.Credential{Uid: pw.uid, Gid: pw.gid}
+	if hasGroup {
+		if cred.Gid, err = lookupGroup(groups, g); err != nil {
+			return nil, "", err
+		}
+	}
+
+	seen := map[uint32]bool{cred.Gid: true}
+	if pw.name != "" {
+		for _, grp := range groups {
+			for _, m := range grp.members {
+				if m == pw.name && !seen[grp.gid] {
+					seen[grp.gid] = true
+					cred.Groups = append(cred.Groups, grp.gid)
+				}
+			}
+		}
+	}
+	implicit := len(cred.Groups)
+	for _, ga := range groupAdd {
+		gid, err := lookupGroup(groups, ga)
+		if err != nil {
+			return nil, "", err
+		}
+		if !seen[gid] {
+			seen[gid] = true
+			cred.Groups = append(cred.Groups, gid)
+		}
+	}
+
+	// In a user namespace whose gid map was written without setgroups
+	// permission, setgroups(2) always fails; keep the (empty) inherited
+	// list rather than failing the exec. The user's memberships from
+	// /etc/group are dropped, but groups asked for with --group-add
+	// cannot be silently left out.
+	if setgroupsDenied() {
+		if len(cred.Groups) > implicit {
+			return nil, "", fmt.Errorf("--group-add: supplementary groups are not available in this user namespace")
+		}
+		cred.Groups = nil
+		cred.NoSetGroups = true
+	}
+	return cred, pw.home, nil
+}
+
+func setgroupsDenied() bool {
+	b, err := os.ReadFile("/proc/self/setgroups")
+	return err == nil && strings.TrimSpace(string(b)) == "deny"
+}
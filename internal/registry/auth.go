@@ -0,0 +1,285 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credentials authenticate to a registry: directly with Basic auth, or
+// at the token endpoint of a registry that uses bearer tokens.
+type Credentials struct {
+	Username string
+	Password string
+
+	// IdentityToken, if set, is an OAuth2 refresh token that is
+	// exchanged for bearer tokens instead of the password, as docker
+	// does for registries that hand one out at login.
+	IdentityToken string
+}
+
+// defaultTokenLifetime applies to tokens that do not say when they
+// expire, as the token spec prescribes.
+const defaultTokenLifetime = 60 * time.Second
+
+// challenge is a parsed WWW-Authenticate header.
+type challenge struct {
+	scheme string // "bearer" or "basic"
+	params map[string]string
+}
+
+type token struct {
+	value   string
+	expires time.Time
+}
+
+// authorizer answers a registry's authentication challenges for the
+// requests of one pull, and caches bearer tokens per scope until they
+// expire. It is safe for concurrent use.
+type authorizer struct {
+	creds  *Credentials
+	lookup func() (*Credentials, error) // of creds, on the first challenge
+	scope  string
+
+	mu        sync.Mutex
+	challenge *challenge
+	tokens    map[string]token
+}
+
+func newAuthorizer(ref ImageRef, creds *Credentials) *authorizer {
+	return &authorizer{
+		creds:  creds,
+		scope:  "repository:" + ref.Repo + ":pull",
+		tokens: map[string]token{},
+	}
+}
+
+// observe records the challenge of a 401 response. It reports whether
+// there was one this client can answer.
+func (a *authorizer) observe(resp *http.Response) bool {
+	var found *challenge
+	for _, h := range resp.Header.Values("WWW-Authenticate") {
+		c := parseChallenge(h)
+		if c == nil {
+			continue
+		}
+		if found == nil || c.scheme == "bearer" {
+			found = c
+		}
+	}
+	if found == nil {
+		return false
+	}
+	a.mu.Lock()
+	a.challenge = found
+	a.mu.Unlock()
+	return true
+}
+
+// authorization returns the Authorization header for the current
+// challenge, if any. A cached token equal to stale, which the registry
+// just refused, is not reused.
+func (a *authorizer) authorization(stale string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.challenge == nil {
+		return "", nil
+	}
+	if a.lookup != nil {
+		creds, err := a.lookup()
+		a.lookup = nil
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ccrun: warning: %v; pulling anonymously\n", err)
+		} else {
+			a.creds = creds
+		}
+	}
+	switch a.challenge.scheme {
+	case "basic":
+		if a.creds == nil || a.creds.Password == "" {
+			return "", errors.New("registry requires credentials")
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(a.creds.Username+":"+a.creds.Password)), nil
+	default:
+		if t, ok := a.tokens[a.scope]; ok && time.Now().Before(t.expires) && "Bearer "+t.value != stale {
+			return "Bearer " + t.value, nil
+		}
+		t, err := a.fetchToken()
+		if err != nil {
+			return "", err
+		}
+		a.tokens[a.scope] = t
+		return "Bearer " + t.value, nil
+	}
+}
+
+// fetchToken asks the realm of a bearer challenge for a token.
+func (a *authorizer) fetchToken() (token, error) {
+	realm := a.challenge.params["realm"]
+	u, err := url.Parse(realm)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return token{}, fmt.Errorf("auth: invalid realm %q", realm)
+	}
+	q := u.Query()
+	if s := a.challenge.params["service"]; s != "" {
+		q.Set("service", s)
+	}
+	if a.scope != "" {
+		q.Set("scope", a.scope)
+	}
+
+	var req *http.Request
+	if a.creds != nil && a.creds.IdentityToken != "" {
+		// an OAuth2 refresh token is posted to the realm rather than
+		// sent as basic auth
+		q.Set("grant_type", "refresh_token")
+		q.Set("refresh_token", a.creds.IdentityToken)
+		q.Set("client_id", "ccrun")
+		req, _ = http.NewRequest("POST", u.String(), strings.NewReader(q.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		u.RawQuery = q.Encode()
+		req, _ = http.NewRequest("GET", u.String(), nil)
+		if a.creds != nil {
+			req.SetBasicAuth(a.creds.Username, a.creds.Password)
+		}
+	}
+	dbg("auth request: %s %s (scope=%q)", req.Method, u.String(), a.scope)
+	resp, err := authClient().Do(req)
+	if err != nil {
+		return token{}, fmt.Errorf("auth: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return token{}, fmt.Errorf("auth: %s", resp.Status)
+	}
+	var body struct {
+		Token       string    `json:"token"`
+		AccessToken string    `json:"access_token"`
+		ExpiresIn   int       `json:"expires_in"`
+		IssuedAt    time.Time `json:"issued_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return token{}, fmt.Errorf("auth: %w", err)
+	}
+	t := token{value: body.Token}
+	if t.value == "" {
+		t.value = body.AccessToken
+	}
+	if t.value == "" {
+		return token{}, errors.New("auth: empty token")
+	}
+	lifetime := defaultTokenLifetime
+	if body.ExpiresIn > 0 {
+		lifetime = time.Duration(body.ExpiresIn) * time.Second
+	}
+	issued := body.IssuedAt
+	if issued.IsZero() || issued.After(time.Now()) {
+		issued = time.Now()
+	}
+	// renew a little early rather than race the expiry
+	t.expires = issued.Add(lifetime * 9 / 10)
+	dbg("auth OK: token(len=%d), expires %s", len(t.value), t.expires.Format(time.RFC3339))
+	return t, nil
+}
+
+// do sends req with whatever authorization the registry asked for. On a
+// 401 it takes up the new challenge, obtains fresh credentials and
+// retries once.
+func (a *authorizer) do(req *http.Request) (*http.Response, error) {
+	h, err := a.authorization("")
+	if err != nil {
+		return nil, err
+	}
+	if h != "" {
+		req.Header.Set("Authorization", h)
+	}
+	resp, err := authClient().Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || !a.observe(resp) {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	h, err = a.authorization(h)
+	if err != nil {
+		return nil, err
+	}
+	retry := req.Clone(req.Context())
+	retry.Header.Set("Authorization", h)
+	dbg("%s %s: 401, retrying with new credentials", req.Method, req.URL)
+	return authClient().Do(retry)
+}
+
+// parseChallenge parses one WWW-Authenticate value such as
+//
+//	Bearer realm="https://auth.example.com/token",service="registry.example.com"
+//
+// It returns nil for schemes other than Bearer and Basic.
+func parseChallenge(h string) *challenge {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(h), " ")
+	scheme = strings.ToLower(scheme)
+	if scheme != "bearer" && scheme != "basic" {
+		return nil
+	}
+	c := &challenge{scheme: scheme, params: map[string]string{}}
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		var key string
+		key, rest, _ = strings.Cut(rest, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			// quoted-string, with backslash escapes
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			value = b.String()
+			rest = rest[min(i+1, len(rest)):]
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+			rest = "," + rest
+		}
+		if key != "" {
+			c.params[key] = strings.TrimSpace(value)
+		}
+		_, rest, _ = strings.Cut(rest, ",")
+		rest = strings.TrimSpace(rest)
+	}
+	return c
+}
+
+// Login checks credentials against the registry serving domain, as
+// docker login does: it requests /v2/ with them, answering whatever
+// challenge the registry sets.
+func Login(domain string, creds Credentials) error {
+	ref := ImageRef{Domain: domain, Registry: domain}
+	if domain == defaultDomain {
+		ref.Registry = dockerHubRegistry
+	}
+	auth := &authorizer{creds: &creds, tokens: map[string]token{}}
+	ref, err := ping(ref, auth)
+	if err != nil {
+		return err
+	}
+	req, _ := http.NewRequest("GET", ref.baseURL()+"/v2/", nil)
+	resp, err := auth.do(req)
+	if err != nil {
+		return fmt.Errorf("login to %s: %w", domain, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("login to %s: %s", domain, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package registry
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseChallenge(t *testing.T) {
+	tests := []struct {
+		in   string
+		want *challenge
+	}{
+		{
+			in: `Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"`,
+			want: &challenge{scheme: "bearer", params: map[string]string{
+				"realm": "https://auth.docker.io/token", "service": "registry.docker.io", "scope": "repository:library/alpine:pull",
+			}},
+		},
+		{
+			in:   `Basic realm="Registry Realm"`,
+			want: &challenge{scheme: "basic", params: map[string]string{"realm": "Registry Realm"}},
+		},
+		{
+			in:   `bearer realm=https://ghcr.io/token, service=ghcr.io`,
+			want: &challenge{scheme: "bearer", params: map[string]string{"realm": "https://ghcr.io/token", "service": "ghcr.io"}},
+		},
+		{
+			in:   `Bearer realm="a\"b,c",error="invalid_token"`,
+			want: &challenge{scheme: "bearer", params: map[string]string{"realm": `a"b,c`, "error": "invalid_token"}},
+		},
+		{in: `Negotiate abc`, want: nil},
+	}
+	for _, tt := range tests {
+		if got := parseChallenge(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// tokenRegistry guards a fakeRegistry with bearer tokens from its own
+// /token endpoint. Each token is accepted for maxUses requests, after
+// which the registry answers 401 as for an expired token.
+type tokenRegistry struct {
+	*fakeRegistry
+	maxUses int
+
+	mu      sync.Mutex
+	issued  int
+	uses    map[string]int
+	queries []string
+	basic   []string
+}
+
+func newTokenRegistry(t *testing.T, maxUses int) *tokenRegistry {
+	r := &tokenRegistry{fakeRegistry: newFakeRegistry(t), maxUses: maxUses, uses: map[string]int{}}
+	r.gate = r.check
+	return r
+}
+
+func (r *tokenRegistry) check(w http.ResponseWriter, req *http.Request) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if req.URL.Path == "/token" {
+		r.issued++
+		// the query of a GET, or the form of an OAuth2 POST
+		req.ParseForm()
+		r.queries = append(r.queries, req.Form.Encode())
+		if u, p, ok := req.BasicAuth(); ok {
+			r.basic = append(r.basic, u+":"+p)
+		}
+		fmt.Fprintf(w, `{"token":"t%d","expires_in":300}`, r.issued)
+		return true
+	}
+	tok, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if ok && strings.HasPrefix(tok, "t") && r.uses[tok] < r.maxUses {
+		r.uses[tok]++
+		return false
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake-registry"`, r.URL))
+	w.WriteHeader(http.StatusUnauthorized)
+	return true
+}
+
+func TestPullWithBearerChallenge(t *testing.T) {
+	reg := newTokenRegistry(t, 100)
+	reg.addImage(t, "v1",
+		[]entry{{name: "a", typ: tar.TypeReg, body: "a"}},
+		[]entry{{name: "b", typ: tar.TypeReg, body: "b"}},
+	)
+	ref, err := ParseImageRef(strings.TrimPrefix(reg.URL, "http://") + "/team/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := testPullOptions(t)
+	opts.Credentials = &Credentials{Username: "ci", Password: "secret"}
+	if err := Pull(ref, t.TempDir(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if reg.issued != 1 {
+		t.Errorf("got %d token requests, want 1 token cached for the pull", reg.issued)
+	}
+	if q := reg.queries[0]; !strings.Contains(q, "scope=repository%3Ateam%2Fapp%3Apull") || !strings.Contains(q, "service=fake-registry") {
+		t.Errorf("token request query %q lacks scope or service", q)
+	}
+	if len(reg.basic) != 1 || reg.basic[0] != "ci:secret" {
+		t.Errorf("token request credentials: got %q", reg.basic)
+	}
+}
+
+func TestPullWithIdentityToken(t *testing.T) {
+	reg := newTokenRegistry(t, 100)
+	reg.addImage(t, "v1", []entry{{name: "a", typ: tar.TypeReg, body: "a"}})
+	ref, err := ParseImageRef(strings.TrimPrefix(reg.URL, "http://") + "/team/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := testPullOptions(t)
+	opts.Credentials = &Credentials{Username: "00000000-0000-0000-0000-000000000000", IdentityToken: "refresh-me"}
+	if err := Pull(ref, t.TempDir(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if len(reg.basic) != 0 {
+		t.Errorf("identity token login sent basic credentials %q", reg.basic)
+	}
+	if q := reg.queries[0]; !strings.Contains(q, "grant_type=refresh_token") || !strings.Contains(q, "refresh_token=refresh-me") || !strings.Contains(q, "scope=repository%3Ateam%2Fapp%3Apull") {
+		t.Errorf("token request %q is not an OAuth2 refresh", q)
+	}
+}
+
+func TestPullRefreshesRejectedToken(t *testing.T) {
+	reg := newTokenRegistry(t, 2)
+	reg.addImage(t, "v1",
+		[]entry{{name: "a", typ: tar.TypeReg, body: "a"}},
+		[]entry{{name: "b", typ: tar.TypeReg, body: "b"}},
+		[]entry{{name: "c", typ: tar.TypeReg, body: "c"}},
+	)
+	ref, err := ParseImageRef(strings.TrimPrefix(reg.URL, "http://") + "/team/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := testPullOptions(t)
+	opts.MaxConcurrentDownloads = 1
+	if err := Pull(ref, t.TempDir(), opts); err != nil {
+		t.Fatal(err)
+	}
+	// manifest, config and three layers at two requests per token
+	if reg.issued != 3 {
+		t.Errorf("got %d token requests, want 3", reg.issued)
+	}
+}
+
+func TestPullWithBasicChallenge(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.gate = func(w http.ResponseWriter, req *http.Request) bool {
+		if u, p, ok := req.BasicAuth(); ok && u == "ci" && p == "secret" {
+			return false
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="fake"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return true
+	}
+	reg.addImage(t, "v1", []entry{{name: "a", typ: tar.TypeReg, body: "a"}})
+	ref, err := ParseImageRef(strings.TrimPrefix(reg.URL, "http://") + "/team/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Pull(ref, t.TempDir(), testPullOptions(t)); err == nil {
+		t.Error("anonymous pull succeeded, want an authentication error")
+	}
+	opts := testPullOptions(t)
+	opts.Credentials = &Credentials{Username: "ci", Password: "secret"}
+	if err := Pull(ref, t.TempDir(), opts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPullLooksUpCredentialsOnlyWhenAsked(t *testing.T) {
+	lookups := 0
+	failing := func() (*Credentials, error) {
+		lookups++
+		return nil, errors.New("docker-credential-broken: not found")
+	}
+
+	open := newFakeRegistry(t)
+	open.addImage(t, "v1", []entry{{name: "a", typ: tar.TypeReg, body: "a"}})
+	ref, err := ParseImageRef(strings.TrimPrefix(open.URL, "http://") + "/team/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := testPullOptions(t)
+	opts.LookupCredentials = failing
+	if err := Pull(ref, t.TempDir(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if lookups != 0 {
+		t.Errorf("credentials looked up %d times for a registry that asked for none", lookups)
+	}
+
+	// a failed lookup leaves the pull anonymous rather than failing it
+	reg := newTokenRegistry(t, 100)
+	reg.addImage(t, "v1", []entry{{name: "a", typ: tar.TypeReg, body: "a"}})
+	ref, err = ParseImageRef(strings.TrimPrefix(reg.URL, "http://") + "/team/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = testPullOptions(t)
+	opts.LookupCredentials = failing
+	if err := Pull(ref, t.TempDir(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if lookups != 1 || len(reg.basic) != 0 {
+		t.Errorf("got %d lookups and credentials %q, want one lookup and an anonymous token", lookups, reg.basic)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.gate = func(w http.ResponseWriter, req *http.Request) bool {
+		if u, p, ok := req.BasicAuth(); ok && u == "ci" && p == "secret" {
+			return false
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="fake"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return true
+	}
+	domain := strings.TrimPrefix(reg.URL, "http://")
+	if err := Login(domain, Credentials{Username: "ci", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Login(domain, Credentials{Username: "ci", Password: "wrong"}); err == nil {
+		t.Error("login with a wrong password succeeded")
+	}
+
+	tokens := newTokenRegistry(t, 100)
+	if err := Login(strings.TrimPrefix(tokens.URL, "http://"), Credentials{Username: "ci", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens.basic) != 1 || strings.Contains(tokens.queries[0], "scope=") {
+		t.Errorf("token request: credentials %q, query %q; want credentials and no scope", tokens.basic, tokens.queries)
+	}
+}
@@ -0,0 +1,302 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Credentials are kept in docker's config.json, so that logins are
+// shared with docker: plain entries under "auths", or credential helper
+// binaries named by "credHelpers" (per registry) and "credsStore".
+
+// dockerHubServer is the key docker uses for Docker Hub.
+const dockerHubServer = "https://index.docker.io/v1/"
+
+// AuthFilePath returns the path of docker's config.json:
+// $DOCKER_CONFIG/config.json or ~/.docker/config.json.
+func AuthFilePath() (string, error) {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".docker", "config.json"), nil
+}
+
+// NormalizeServer turns what a user may call a registry, such as
+// https://index.docker.io/v1/, index.docker.io or ghcr.io, into the
+// domain used in image references.
+func NormalizeServer(server string) string {
+	s := server
+	if i := strings.Index(s, "://"); i >= 0 {
+		s = s[i+3:]
+	}
+	s, _, _ = strings.Cut(s, "/")
+	switch s {
+	case "", "index.docker.io", dockerHubRegistry:
+		return defaultDomain
+	}
+	return s
+}
+
+// authServer is the key a domain's entry has in config.json.
+func authServer(domain string) string {
+	if domain == defaultDomain {
+		return dockerHubServer
+	}
+	return domain
+}
+
+// authEntry is an entry of "auths". Docker and other tools may store
+// further fields, so entries are kept raw and only decoded when used.
+type authEntry struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// credentialFields are the fields of an entry that a new login replaces.
+var credentialFields = []string{"auth", "username", "password", "identitytoken", "registrytoken"}
+
+// authFile is the part of config.json that ccrun reads. Everything else
+// in the file is preserved when it is written back.
+type authFile struct {
+	raw         map[string]json.RawMessage
+	Auths       map[string]json.RawMessage
+	CredHelpers map[string]string
+	CredsStore  string
+}
+
+func loadAuthFile() (*authFile, string, error) {
+	path, err := AuthFilePath()
+	if err != nil {
+		return nil, "", err
+	}
+	f := &authFile{raw: map[string]json.RawMessage{}, Auths: map[string]json.RawMessage{}}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, path, nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if err := json.Unmarshal(b, &f.raw); err != nil {
+		return nil, "", fmt.Errorf("%s: %w", path, err)
+	}
+	for key, dst := range map[string]any{"auths": &f.Auths, "credHelpers": &f.CredHelpers, "credsStore": &f.CredsStore} {
+		if v, ok := f.raw[key]; ok {
+			if err := json.Unmarshal(v, dst); err != nil {
+				return nil, "", fmt.Errorf("%s: %s: %w", path, key, err)
+			}
+		}
+	}
+	if f.Auths == nil {
+		f.Auths = map[string]json.RawMessage{}
+	}
+	return f, path, nil
+}
+
+func (f *authFile) save(path string) error {
+	auths, err := json.Marshal(f.Auths)
+	if err != nil {
+		return err
+	}
+	f.raw["auths"] = auths
+	b, err := json.MarshalIndent(f.raw, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", append(b, '\n'), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// entry finds the auths entry for domain. Keys are matched loosely, since
+// they may have been written with a scheme or a path.
+func (f *authFile) entry(domain string) (string, json.RawMessage, bool) {
+	if e, ok := f.Auths[authServer(domain)]; ok {
+		return authServer(domain), e, true
+	}
+	for k, e := range f.Auths {
+		if NormalizeServer(k) == domain {
+			return k, e, true
+		}
+	}
+	return "", nil, false
+}
+
+// helper returns the credential helper responsible for domain, if any.
+func (f *authFile) helper(domain string) string {
+	if h, ok := f.CredHelpers[authServer(domain)]; ok {
+		return h
+	}
+	if h, ok := f.CredHelpers[domain]; ok {
+		return h
+	}
+	return f.CredsStore
+}
+
+// LoadCredentials returns the stored credentials for a registry domain,
+// or nil if there are none.
+func LoadCredentials(domain string) (*Credentials, error) {
+	f, _, err := loadAuthFile()
+	if err != nil {
+		return nil, err
+	}
+	if h := f.helper(domain); h != "" {
+		return helperGet(h, authServer(domain))
+	}
+	_, raw, ok := f.entry(domain)
+	if !ok {
+		return nil, nil
+	}
+	var e authEntry
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return nil, fmt.Errorf("credentials for %s: %w", domain, err)
+	}
+	c := &Credentials{Username: e.Username, Password: e.Password, IdentityToken: e.IdentityToken}
+	if e.Auth != "" {
+		b, err := base64.StdEncoding.DecodeString(e.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("credentials for %s: %w", domain, err)
+		}
+		user, pass, ok := strings.Cut(string(b), ":")
+		if !ok {
+			return nil, fmt.Errorf("credentials for %s: malformed auth entry", domain)
+		}
+		c.Username, c.Password = user, pass
+	}
+	if *c == (Credentials{}) {
+		return nil, nil
+	}
+	return c, nil
+}
+
+// SaveCredentials stores credentials for a registry domain, in its
+// credential helper if one is configured.
+func SaveCredentials(domain string, c Credentials) error {
+	f, path, err := loadAuthFile()
+	if err != nil {
+		return err
+	}
+	if h := f.helper(domain); h != "" {
+		return helperStore(h, authServer(domain), c)
+	}
+	// other fields of an existing entry, such as email, are kept
+	e := map[string]json.RawMessage{}
+	if k, raw, ok := f.entry(domain); ok {
+		if err := json.Unmarshal(raw, &e); err != nil {
+			return fmt.Errorf("credentials for %s: %w", domain, err)
+		}
+		delete(f.Auths, k)
+	}
+	for _, k := range credentialFields {
+		delete(e, k)
+	}
+	auth, _ := json.Marshal(base64.StdEncoding.EncodeToString([]byte(c.Username + ":" + c.Password)))
+	e["auth"] = auth
+	if c.IdentityToken != "" {
+		e["identitytoken"], _ = json.Marshal(c.IdentityToken)
+	}
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f.Auths[authServer(domain)] = raw
+	return f.save(path)
+}
+
+// EraseCredentials removes the stored credentials for a registry domain.
+// It reports whether there were any.
+func EraseCredentials(domain string) (bool, error) {
+	f, path, err := loadAuthFile()
+	if err != nil {
+		return false, err
+	}
+	if h := f.helper(domain); h != "" {
+		return true, runHelper(h, "erase", strings.NewReader(authServer(domain)), nil)
+	}
+	k, _, ok := f.entry(domain)
+	if !ok {
+		return false, nil
+	}
+	delete(f.Auths, k)
+	return true, f.save(path)
+}
+
+// helperCredentials is the JSON that docker-credential-* helpers speak.
+type helperCredentials struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// helperTokenUser is the user name under which helpers keep an
+// identity token.
+const helperTokenUser = "<token>"
+
+// errHelperNotFound is how helpers report that they have nothing stored.
+const errHelperNotFound = "credentials not found in native keychain"
+
+func helperGet(helper, server string) (*Credentials, error) {
+	var out bytes.Buffer
+	err := runHelper(helper, "get", strings.NewReader(server), &out)
+	if err != nil {
+		if strings.Contains(err.Error(), errHelperNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var hc helperCredentials
+	if err := json.Unmarshal(out.Bytes(), &hc); err != nil {
+		return nil, fmt.Errorf("docker-credential-%s get: %w", helper, err)
+	}
+	if hc.Username == helperTokenUser {
+		return &Credentials{IdentityToken: hc.Secret}, nil
+	}
+	return &Credentials{Username: hc.Username, Password: hc.Secret}, nil
+}
+
+func helperStore(helper, server string, c Credentials) error {
+	hc := helperCredentials{ServerURL: server, Username: c.Username, Secret: c.Password}
+	if c.IdentityToken != "" {
+		hc.Username, hc.Secret = helperTokenUser, c.IdentityToken
+	}
+	b, err := json.Marshal(hc)
+	if err != nil {
+		return err
+	}
+	return runHelper(helper, "store", bytes.NewReader(b), nil)
+}
+
+// runHelper runs docker-credential-<helper> <action> with stdin.
+func runHelper(helper, action string, stdin io.Reader, stdout io.Writer) error {
+	name := "docker-credential-" + helper
+	cmd := exec.Command(name, action)
+	cmd.Stdin = stdin
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %w: %s", name, action, err, strings.TrimSpace(out.String()))
+	}
+	if stdout != nil {
+		stdout.Write(out.Bytes())
+	}
+	return nil
+}
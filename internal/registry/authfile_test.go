@@ -0,0 +1,131 @@
+package registry
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuthFileRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", dir)
+	path := filepath.Join(dir, "config.json")
+	// docker and others wrote this: a Hub login, a registry with a
+	// scheme, an identity token from az acr login, plain username and
+	// password fields, and settings ccrun knows nothing about
+	os.WriteFile(path, []byte(`{
+		"auths": {
+			"https://index.docker.io/v1/": {"auth": "aHViOnNlY3JldA==", "email": "hub@example.com"},
+			"https://ghcr.io": {"auth": "Z2g6dG9rZW4="},
+			"myregistry.azurecr.io": {"auth": "MDAwMDAwMDAtMDAwMC0wMDAwLTAwMDAtMDAwMDAwMDAwMDAwOg==", "identitytoken": "refresh-me", "registrytoken": "rt"},
+			"plain.example.com": {"username": "pu", "password": "pp"}
+		},
+		"detachKeys": "ctrl-x"
+	}`), 0o600)
+
+	for domain, want := range map[string]*Credentials{
+		"docker.io":             {Username: "hub", Password: "secret"},
+		"ghcr.io":               {Username: "gh", Password: "token"},
+		"myregistry.azurecr.io": {Username: "00000000-0000-0000-0000-000000000000", IdentityToken: "refresh-me"},
+		"plain.example.com":     {Username: "pu", Password: "pp"},
+		"localhost:5000":        nil,
+	} {
+		got, err := LoadCredentials(domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (got == nil) != (want == nil) || got != nil && *got != *want {
+			t.Errorf("%s: got %+v, want %+v", domain, got, want)
+		}
+	}
+
+	if err := SaveCredentials("localhost:5000", Credentials{Username: "me", Password: "p:w"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := LoadCredentials("localhost:5000"); got == nil || got.Password != "p:w" {
+		t.Errorf("after save: got %+v", got)
+	}
+	if found, err := EraseCredentials("ghcr.io"); !found || err != nil {
+		t.Errorf("erase ghcr.io: %v, %v", found, err)
+	}
+	if found, _ := EraseCredentials("ghcr.io"); found {
+		t.Error("erase ghcr.io twice: found")
+	}
+
+	var raw map[string]json.RawMessage
+	b, _ := os.ReadFile(path)
+	if err := json.Unmarshal(b, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if string(raw["detachKeys"]) != `"ctrl-x"` {
+		t.Errorf("detachKeys not preserved: %s", b)
+	}
+	// entries ccrun did not touch keep every field
+	var auths map[string]map[string]string
+	if err := json.Unmarshal(raw["auths"], &auths); err != nil {
+		t.Fatal(err)
+	}
+	if e := auths["myregistry.azurecr.io"]; e["identitytoken"] != "refresh-me" || e["registrytoken"] != "rt" {
+		t.Errorf("azurecr entry not preserved: %v", e)
+	}
+	if e := auths["https://index.docker.io/v1/"]; e["email"] != "hub@example.com" {
+		t.Errorf("docker hub entry not preserved: %v", e)
+	}
+
+	// a new login replaces the credentials of an entry, not its other
+	// fields
+	if err := SaveCredentials("docker.io", Credentials{Username: "hub", Password: "new"}); err != nil {
+		t.Fatal(err)
+	}
+	b, _ = os.ReadFile(path)
+	json.Unmarshal(b, &raw)
+	json.Unmarshal(raw["auths"], &auths)
+	if e := auths["https://index.docker.io/v1/"]; e["email"] != "hub@example.com" || e["auth"] != "aHViOm5ldw==" {
+		t.Errorf("docker hub entry after login: %v", e)
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0o600 {
+		t.Errorf("mode %v", fi.Mode().Perm())
+	}
+}
+
+func TestAuthFileCredentialHelper(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", dir)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	store := filepath.Join(dir, "stored")
+	// a helper that keeps one set of credentials in a file
+	os.WriteFile(filepath.Join(dir, "docker-credential-test"), []byte(`#!/bin/sh
+case "$1" in
+store) cat > "`+store+`" ;;
+get) cat "`+store+`" 2>/dev/null || { echo "credentials not found in native keychain"; exit 1; } ;;
+erase) rm "`+store+`" ;;
+esac
+`), 0o755)
+	os.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"credHelpers": {"registry.example.com": "test"}}`), 0o600)
+
+	if got, err := LoadCredentials("registry.example.com"); got != nil || err != nil {
+		t.Fatalf("before store: %+v, %v", got, err)
+	}
+	if err := SaveCredentials("registry.example.com", Credentials{Username: "u", Password: "s"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadCredentials("registry.example.com")
+	if err != nil || got == nil || *got != (Credentials{Username: "u", Password: "s"}) {
+		t.Fatalf("after store: %+v, %v", got, err)
+	}
+	// the secret stays with the helper
+	if b, _ := os.ReadFile(filepath.Join(dir, "config.json")); string(b) != `{"credHelpers": {"registry.example.com": "test"}}` {
+		t.Errorf("config.json rewritten: %s", b)
+	}
+	if _, err := EraseCredentials("registry.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(store); !os.IsNotExist(err) {
+		t.Errorf("helper store not erased: %v", err)
+	}
+	// registries without a helper still use auths
+	if got, err := LoadCredentials("docker.io"); got != nil || err != nil {
+		t.Errorf("docker.io: %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,56 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ImageConfig is the subset of the OCI/Docker image configuration that
+// ccrun uses.
+type ImageConfig struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+	Config       struct {
+		User       string   `json:"User"`
+		Env        []string `json:"Env"`
+		Entrypoint []string `json:"Entrypoint"`
+		Cmd        []string `json:"Cmd"`
+		WorkingDir string   `json:"WorkingDir"`
+	} `json:"config"`
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+func ParseImageConfig(b []byte) (*ImageConfig, error) {
+	var c ImageConfig
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("image config: %w", err)
+	}
+	return &c, nil
+}
+
+// LoadImageConfig reads the config.json that Pull stores next to an
+// image's rootfs.
+func LoadImageConfig(path string) (*ImageConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseImageConfig(b)
+}
+
+// IsImageDir reports whether dir holds an image written by Pull, as
+// opposed to, say, an OCI bundle whose config.json is a runtime spec.
+func IsImageDir(dir string) bool {
+	for _, name := range []string{"manifest.json", platformFile} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
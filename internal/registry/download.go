@@ -0,0 +1,121 @@
+package registry
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Blob downloads are retried with exponential backoff on transient
+// failures: connection errors, 429 and 5xx.
+var (
+	blobAttempts   = 5
+	blobBackoff    = 500 * time.Millisecond
+	blobMaxBackoff = 30 * time.Second
+)
+
+// fetchBlob downloads a blob into the store unless it is already there.
+// Data received before a failure is kept in a partial file, and later
+// attempts, including those of later pulls, ask only for the rest with a
+// Range request. The whole blob is verified before it is stored. If
+// progress is not nil, it is called with the number of bytes received.
+func fetchBlob(ref ImageRef, auth *authorizer, digest string, blobs *BlobStore, progress func(int64)) error {
+	digest = normalizeDigest(digest)
+	if blobs.Has(digest) {
+		dbg("blob %s: cached", digest)
+		return nil
+	}
+	f, err := blobs.openPartial(digest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if blobs.Has(digest) {
+		// another pull finished it while we waited for the lock
+		blobs.discardPartial(digest, f)
+		return nil
+	}
+
+	backoff := blobBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := fetchBlobOnce(ref, auth, digest, f, progress)
+		if err == nil {
+			if err = blobs.commitPartial(digest, f); err == nil {
+				return nil
+			}
+			retry = true
+		}
+		if !retry || attempt >= blobAttempts {
+			return fmt.Errorf("blob %s: %w", digest, err)
+		}
+		dbg("blob %s: attempt %d: %v; retrying in %s", digest, attempt, err, backoff)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, blobMaxBackoff)
+	}
+}
+
+// fetchBlobOnce appends the part of the blob that f does not have yet.
+// It reports whether a failure is worth retrying.
+func fetchBlobOnce(ref ImageRef, auth *authorizer, digest string, f *os.File, progress func(int64)) (retry bool, err error) {
+	off, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+	u := ref.baseURL() + "/v2/" + ref.Repo + "/blobs/" + digest
+	req, _ := http.NewRequest("GET", u, nil)
+	req.Header.Set("Accept", "application/octet-stream")
+	if off > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+	}
+	dbg("blob GET %s (from %d)", u, off)
+	resp, err := auth.do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && off > 0:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != off {
+			// not the range we asked for; start over
+			if err := restart(f); err != nil {
+				return false, err
+			}
+			return true, fmt.Errorf("unexpected Content-Range %q", resp.Header.Get("Content-Range"))
+		}
+	case resp.StatusCode == http.StatusOK:
+		// the server ignored the range and sends the whole blob
+		if err := restart(f); err != nil {
+			return false, err
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && off > 0:
+		// nothing left to send; the digest check decides
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("%s", resp.Status)
+	default:
+		return false, fmt.Errorf("%s", resp.Status)
+	}
+
+	var body io.Reader = resp.Body
+	if progress != nil {
+		start, _ := f.Seek(0, io.SeekCurrent)
+		body = &progressReader{r: resp.Body, n: start, fn: progress}
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		return true, err
+	}
+	return false, nil
+}
+
+// restart empties a partial download.
+func restart(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	return err
+}
@@ -0,0 +1,239 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blobServer serves one blob, handing each request to the next of
+// handlers and to http.ServeContent, which honours Range, once they run
+// out. It records the Range header of every request.
+type blobServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	ranges   []string
+	handlers []func(w http.ResponseWriter, r *http.Request) bool
+}
+
+func newBlobServer(t *testing.T, blob []byte, handlers ...func(w http.ResponseWriter, r *http.Request) bool) (*blobServer, ImageRef, string) {
+	t.Helper()
+	s := &blobServer{handlers: handlers}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+		var h func(http.ResponseWriter, *http.Request) bool
+		if len(s.handlers) > 0 {
+			h, s.handlers = s.handlers[0], s.handlers[1:]
+		}
+		s.mu.Unlock()
+		if h != nil && h(w, r) {
+			return
+		}
+		http.ServeContent(w, r, "blob", time.Time{}, bytes.NewReader(blob))
+	}))
+	t.Cleanup(s.Close)
+
+	old, oldBackoff := transport, blobBackoff
+	transport, blobBackoff = s.Client().Transport, time.Millisecond
+	t.Cleanup(func() { transport, blobBackoff = old, oldBackoff })
+
+	sum := sha256.Sum256(blob)
+	ref := ImageRef{Registry: strings.TrimPrefix(s.URL, "https://"), Repo: "library/test", Tag: "latest"}
+	return s, ref, "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// dropAfter sends the headers for the whole blob but only n bytes of it,
+// then closes the connection.
+func dropAfter(blob []byte, n int) func(http.ResponseWriter, *http.Request) bool {
+	return func(w http.ResponseWriter, r *http.Request) bool {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n", len(blob))
+		buf.Write(blob[:n])
+		buf.Flush()
+		conn.Close()
+		return true
+	}
+}
+
+func status(code int) func(http.ResponseWriter, *http.Request) bool {
+	return func(w http.ResponseWriter, r *http.Request) bool {
+		w.WriteHeader(code)
+		return true
+	}
+}
+
+func testBlob() []byte {
+	return bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+}
+
+func assertStored(t *testing.T, blobs *BlobStore, digest string, want []byte) {
+	t.Helper()
+	got, err := blobs.Get(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("stored blob differs: %d bytes, want %d", len(got), len(want))
+	}
+	p, _ := blobs.Path(digest)
+	if _, err := os.Stat(p + ".partial"); !os.IsNotExist(err) {
+		t.Errorf("partial file left behind: %v", err)
+	}
+}
+
+func TestFetchBlobResumesAfterDrop(t *testing.T) {
+	blob := testBlob()
+	s, ref, digest := newBlobServer(t, blob, dropAfter(blob, 100000))
+	blobs := NewBlobStore(t.TempDir())
+
+	if err := fetchBlob(ref, newAuthorizer(ref, nil), digest, blobs, nil); err != nil {
+		t.Fatal(err)
+	}
+	assertStored(t, blobs, digest, blob)
+	if len(s.ranges) != 2 || s.ranges[0] != "" || s.ranges[1] != "bytes=100000-" {
+		t.Errorf("requests: got ranges %q, want a full GET then bytes=100000-", s.ranges)
+	}
+}
+
+func TestFetchBlobResumesAcrossPulls(t *testing.T) {
+	blob := testBlob()
+	drops := make([]func(http.ResponseWriter, *http.Request) bool, blobAttempts)
+	for i := range drops {
+		drops[i] = dropAfter(blob, 1000)
+	}
+	s, ref, digest := newBlobServer(t, blob, drops...)
+	blobs := NewBlobStore(t.TempDir())
+
+	if err := fetchBlob(ref, newAuthorizer(ref, nil), digest, blobs, nil); err == nil {
+		t.Fatal("fetch succeeded, want the server's failures")
+	}
+	// the next pull continues where the last one stopped
+	if err := fetchBlob(ref, newAuthorizer(ref, nil), digest, blobs, nil); err != nil {
+		t.Fatal(err)
+	}
+	assertStored(t, blobs, digest, blob)
+	if last := s.ranges[len(s.ranges)-1]; last == "" {
+		t.Errorf("second pull did not resume: ranges %q", s.ranges)
+	}
+}
+
+func TestFetchBlobRetriesTransientStatus(t *testing.T) {
+	blob := testBlob()
+	s, ref, digest := newBlobServer(t, blob, status(http.StatusTooManyRequests), status(http.StatusBadGateway))
+	blobs := NewBlobStore(t.TempDir())
+
+	if err := fetchBlob(ref, newAuthorizer(ref, nil), digest, blobs, nil); err != nil {
+		t.Fatal(err)
+	}
+	assertStored(t, blobs, digest, blob)
+	if len(s.ranges) != 3 {
+		t.Errorf("got %d requests, want 3", len(s.ranges))
+	}
+}
+
+func TestFetchBlobDoesNotRetryNotFound(t *testing.T) {
+	blob := testBlob()
+	s, ref, digest := newBlobServer(t, blob, status(http.StatusNotFound))
+	blobs := NewBlobStore(t.TempDir())
+
+	if err := fetchBlob(ref, newAuthorizer(ref, nil), digest, blobs, nil); err == nil {
+		t.Fatal("fetch succeeded, want 404")
+	}
+	if len(s.ranges) != 1 {
+		t.Errorf("got %d requests, want 1", len(s.ranges))
+	}
+	if blobs.Has(digest) {
+		t.Error("blob stored after 404")
+	}
+}
+
+func TestFetchBlobRestartsCorruptPartial(t *testing.T) {
+	blob := testBlob()
+	_, ref, digest := newBlobServer(t, blob)
+	blobs := NewBlobStore(t.TempDir())
+
+	// a partial download whose bytes do not match the blob
+	p, _ := blobs.Path(digest)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p+".partial", bytes.Repeat([]byte("x"), 5000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetchBlob(ref, newAuthorizer(ref, nil), digest, blobs, nil); err != nil {
+		t.Fatal(err)
+	}
+	assertStored(t, blobs, digest, blob)
+}
+
+func TestOpenPartialSkipsCommittedFile(t *testing.T) {
+	blob := testBlob()
+	sum := sha256.Sum256(blob)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	blobs := NewBlobStore(t.TempDir())
+	p, _ := blobs.Path(digest)
+
+	first, err := blobs.openPartial(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	waiter := make(chan *os.File)
+	go func() {
+		f, err := blobs.openPartial(digest)
+		if err != nil {
+			t.Error(err)
+		}
+		waiter <- f
+	}()
+
+	// the first pull finishes while the second waits for its lock
+	time.Sleep(50 * time.Millisecond)
+	if _, err := first.Write(blob); err != nil {
+		t.Fatal(err)
+	}
+	if err := blobs.commitPartial(digest, first); err != nil {
+		t.Fatal(err)
+	}
+	first.Close()
+
+	second := <-waiter
+	if second == nil {
+		t.FailNow()
+	}
+	defer second.Close()
+	if !isPartial(second, p+".partial") {
+		t.Fatal("waiter locked a file that is no longer the partial download")
+	}
+
+	// a third pull's download must survive the second one discarding its own
+	third, err := os.Create(p + ".partial.third")
+	if err != nil {
+		t.Fatal(err)
+	}
+	third.Close()
+	if err := os.Rename(p+".partial.third", p+".partial"); err != nil {
+		t.Fatal(err)
+	}
+	blobs.discardPartial(digest, second)
+	if _, err := os.Stat(p + ".partial"); err != nil {
+		t.Errorf("another pull's partial download was removed: %v", err)
+	}
+	got, err := blobs.Get(digest)
+	if err != nil || !bytes.Equal(got, blob) {
+		t.Errorf("stored blob damaged: %v", err)
+	}
+}
@@ -0,0 +1,237 @@
+package registry
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/alafilearnstocode/ccrun/internal/rootfs"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// unpackLayer applies every entry of a layer tarball on top of root.
+func unpackLayer(tr *tar.Reader, root string, opts *PullOptions) error {
+	// Directory times are restored last: creating entries inside a
+	// directory bumps its mtime.
+	type dirTime struct {
+		full string
+		hdr  *tar.Header
+	}
+	var dirs []dirTime
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		full, err := applyTarEntry(root, hdr, tr, opts)
+		if err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTime{full, hdr})
+		}
+	}
+	for _, d := range dirs {
+		if err := restoreTimes(d.full, d.hdr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanEntryName cleans a path from a tar header and rejects names that
+// would leave the archive root.
+func cleanEntryName(name string) (string, error) {
+	clean := path.Clean(name)
+	if path.IsAbs(clean) {
+		clean = path.Clean(strings.TrimLeft(clean, "/"))
+	}
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("path %q escapes the layer root", name)
+	}
+	return clean, nil
+}
+
+// resolveInRoot returns the host path for name inside root. Symlinks in
+// the parent directories are resolved as if root were "/" so that links
+// planted by earlier entries cannot redirect writes outside root. The
+// final component is not followed: the entry replaces whatever is there.
+func resolveInRoot(root, name string) (string, error) {
+	clean, err := cleanEntryName(name)
+	if err != nil {
+		return "", err
+	}
+	if clean == "." {
+		return root, nil
+	}
+	parent, err := rootfs.SecureJoin(root, path.Dir(clean))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, path.Base(clean)), nil
+}
+
+// markOpaque sets the overlayfs opaque flag on dir, so that it hides the
+// directory of the same name in lower layers. trusted.* is used by mounts
+// made by the host root, user.* by mounts made in a user namespace; the
+// former can only be set with privileges.
+func markOpaque(dir string) error {
+	errTrusted := unix.Lsetxattr(dir, "trusted.overlay.opaque", []byte("y"), 0)
+	errUser := unix.Lsetxattr(dir, "user.overlay.opaque", []byte("y"), 0)
+	if errTrusted != nil && errUser != nil {
+		return fmt.Errorf("mark %s opaque: %w", dir, errUser)
+	}
+	return nil
+}
+
+// removeUnlessDir clears the way for a new entry at full. An existing
+// directory is kept when the new entry is also a directory.
+func removeUnlessDir(full string, keepDir bool) error {
+	fi, err := os.Lstat(full)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if keepDir && fi.IsDir() {
+		return nil
+	}
+	return os.RemoveAll(full)
+}
+
+// applyTarEntry applies a single entry and returns the host path it was
+// written to.
+func applyTarEntry(root string, hdr *tar.Header, r io.Reader, opts *PullOptions) (string, error) {
+	full, err := resolveInRoot(root, hdr.Name)
+	if err != nil {
+		return "", err
+	}
+	base := filepath.Base(full)
+	dir := filepath.Dir(full)
+
+	// Layers are kept as separate directories and stacked with overlayfs,
+	// so whiteouts are converted to the form overlayfs understands rather
+	// than applied.
+	if base == whiteoutOpaque {
+		if err := mkdirAll(dir, opts); err != nil {
+			return "", err
+		}
+		return full, markOpaque(dir)
+	}
+	if strings.HasPrefix(base, whiteoutPrefix) {
+		victim := strings.TrimPrefix(base, whiteoutPrefix)
+		if victim == "" || victim == "." || victim == ".." {
+			return "", fmt.Errorf("invalid whiteout %q", hdr.Name)
+		}
+		if err := mkdirAll(dir, opts); err != nil {
+			return "", err
+		}
+		full = filepath.Join(dir, victim)
+		if err := removeUnlessDir(full, false); err != nil {
+			return "", err
+		}
+		return full, unix.Mknod(full, unix.S_IFCHR, 0)
+	}
+	if full == root && hdr.Typeflag != tar.TypeDir {
+		return "", fmt.Errorf("cannot replace the layer root")
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := removeUnlessDir(full, true); err != nil {
+			return "", err
+		}
+		if err := mkdirAll(full, opts); err != nil {
+			return "", err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		if err := mkdirAll(dir, opts); err != nil {
+			return "", err
+		}
+		if err := removeUnlessDir(full, false); err != nil {
+			return "", err
+		}
+		f, err := os.OpenFile(full, os.O_CREATE|os.O_EXCL|os.O_WRONLY|unix.O_NOFOLLOW, 0o600)
+		if err != nil {
+			return "", err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return "", err
+		}
+		if err := f.Close(); err != nil {
+			return "", err
+		}
+	case tar.TypeSymlink:
+		if err := mkdirAll(dir, opts); err != nil {
+			return "", err
+		}
+		if err := removeUnlessDir(full, false); err != nil {
+			return "", err
+		}
+		if err := os.Symlink(hdr.Linkname, full); err != nil {
+			return "", err
+		}
+	case tar.TypeLink:
+		// Hard link targets are archive paths too. Resolve them the
+		// same way, and refuse anything that would reach outside root.
+		target, err := resolveInRoot(root, hdr.Linkname)
+		if err != nil {
+			return "", fmt.Errorf("hard link to %q: %w", hdr.Linkname, err)
+		}
+		if target == root {
+			return "", fmt.Errorf("hard link to the layer root")
+		}
+		if err := mkdirAll(dir, opts); err != nil {
+			return "", err
+		}
+		if err := removeUnlessDir(full, false); err != nil {
+			return "", err
+		}
+		// a hard link shares the target's inode and metadata
+		return full, unix.Linkat(unix.AT_FDCWD, target, unix.AT_FDCWD, full, 0)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if err := mkdirAll(dir, opts); err != nil {
+			return "", err
+		}
+		if err := removeUnlessDir(full, false); err != nil {
+			return "", err
+		}
+		mode := uint32(hdr.Mode & 0o7777)
+		switch hdr.Typeflag {
+		case tar.TypeChar:
+			mode |= unix.S_IFCHR
+		case tar.TypeBlock:
+			mode |= unix.S_IFBLK
+		default:
+			mode |= unix.S_IFIFO
+		}
+		dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		if err := unix.Mknod(full, mode, int(dev)); err != nil {
+			// device nodes need privileges; /dev is set up at run time
+			if errors.Is(err, unix.EPERM) && hdr.Typeflag != tar.TypeFifo {
+				dbg("skip device %s: %v", hdr.Name, err)
+				return full, nil
+			}
+			return "", err
+		}
+	default:
+		return full, nil
+	}
+
+	return full, applyMetadata(full, hdr, opts)
+}
@@ -0,0 +1,320 @@
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+type entry struct {
+	name, link string
+	typ        byte
+	body       string
+	uid, gid   int
+}
+
+func layer(t *testing.T, entries ...entry) *tar.Reader {
+	t.Helper()
+	return tar.NewReader(bytes.NewReader(layerTar(t, entries...)))
+}
+
+func layerTar(t *testing.T, entries ...entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Linkname: e.link, Typeflag: e.typ, Mode: 0o644, Size: int64(len(e.body)), Uid: e.uid, Gid: e.gid}
+		if e.typ == tar.TypeDir {
+			hdr.Mode = 0o755
+		}
+		if e.typ != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte(e.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// rootlessOptions maps the container's root to the caller, as a rootless
+// run without subordinate ids does, so that unprivileged tests can give
+// what they unpack to it.
+func rootlessOptions() *PullOptions {
+	return &PullOptions{
+		UIDMap: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GIDMap: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+	}
+}
+
+// sandbox returns a rootfs and a sibling directory holding a single
+// file, victim, that no layer may touch.
+func sandbox(t *testing.T) (root, outside string) {
+	t.Helper()
+	base := t.TempDir()
+	root = filepath.Join(base, "rootfs")
+	outside = filepath.Join(base, "outside")
+	for _, d := range []string{root, outside} {
+		if err := os.Mkdir(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "victim"), []byte("original"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return root, outside
+}
+
+func assertUntouched(t *testing.T, outside string) {
+	t.Helper()
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "victim" {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("outside dir changed: %v", names)
+	}
+	b, err := os.ReadFile(filepath.Join(outside, "victim"))
+	if err != nil {
+		t.Fatalf("victim: %v", err)
+	}
+	if string(b) != "original" {
+		t.Errorf("victim rewritten: %q", b)
+	}
+}
+
+func TestUnpackLayerMalicious(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries func(outside string) []entry
+		wantErr bool
+	}{
+		{
+			name: "dotdot name",
+			entries: func(string) []entry {
+				return []entry{{name: "../outside/victim", typ: tar.TypeReg, body: "pwned"}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "dotdot in the middle",
+			entries: func(string) []entry {
+				return []entry{{name: "a/../../outside/new", typ: tar.TypeReg, body: "pwned"}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "absolute name",
+			entries: func(outside string) []entry {
+				return []entry{{name: filepath.Join(outside, "victim"), typ: tar.TypeReg, body: "pwned"}}
+			},
+		},
+		{
+			name: "absolute symlink dir",
+			entries: func(outside string) []entry {
+				return []entry{
+					{name: "evil", typ: tar.TypeSymlink, link: outside},
+					{name: "evil/victim", typ: tar.TypeReg, body: "pwned"},
+				}
+			},
+		},
+		{
+			name: "relative symlink dir",
+			entries: func(string) []entry {
+				return []entry{
+					{name: "a/", typ: tar.TypeDir},
+					{name: "a/evil", typ: tar.TypeSymlink, link: "../../outside"},
+					{name: "a/evil/new", typ: tar.TypeReg, body: "pwned"},
+				}
+			},
+		},
+		{
+			name: "file over symlink",
+			entries: func(outside string) []entry {
+				return []entry{
+					{name: "link", typ: tar.TypeSymlink, link: filepath.Join(outside, "victim")},
+					{name: "link", typ: tar.TypeReg, body: "pwned"},
+				}
+			},
+		},
+		{
+			name: "dir over symlink",
+			entries: func(outside string) []entry {
+				return []entry{
+					{name: "link", typ: tar.TypeSymlink, link: outside},
+					{name: "link/", typ: tar.TypeDir},
+					{name: "link/new", typ: tar.TypeReg, body: "pwned"},
+				}
+			},
+		},
+		{
+			name: "hardlink outside",
+			entries: func(string) []entry {
+				return []entry{{name: "hl", typ: tar.TypeLink, link: "../outside/victim"}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "hardlink through symlink",
+			entries: func(outside string) []entry {
+				return []entry{
+					{name: "evil", typ: tar.TypeSymlink, link: outside},
+					{name: "hl", typ: tar.TypeLink, link: "evil/victim"},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "whiteout dotdot",
+			entries: func(string) []entry {
+				return []entry{{name: "a/.wh..", typ: tar.TypeReg}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "whiteout through symlink",
+			entries: func(outside string) []entry {
+				return []entry{
+					{name: "evil", typ: tar.TypeSymlink, link: outside},
+					{name: "evil/.wh.victim", typ: tar.TypeReg},
+				}
+			},
+		},
+		{
+			name: "opaque through symlink",
+			entries: func(outside string) []entry {
+				return []entry{
+					{name: "evil", typ: tar.TypeSymlink, link: outside},
+					{name: "evil/.wh..wh..opq", typ: tar.TypeReg},
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, outside := sandbox(t)
+			err := unpackLayer(layer(t, tt.entries(outside)...), root, rootlessOptions())
+			if tt.wantErr && err == nil {
+				t.Error("unpack succeeded, want error")
+			}
+			assertUntouched(t, outside)
+		})
+	}
+}
+
+func TestUnpackLayerConfined(t *testing.T) {
+	root, outside := sandbox(t)
+	tr := layer(t,
+		entry{name: "evil", typ: tar.TypeSymlink, link: outside},
+		entry{name: "evil/victim", typ: tar.TypeReg, body: "inside"},
+		entry{name: "rel", typ: tar.TypeSymlink, link: "../../.."},
+		entry{name: "rel/etc/x", typ: tar.TypeReg, body: "inside"},
+	)
+	if err := unpackLayer(tr, root, rootlessOptions()); err != nil {
+		t.Fatal(err)
+	}
+	assertUntouched(t, outside)
+	// writes through a symlink land where the link points inside root
+	for _, p := range []string{filepath.Join(outside, "victim"), "etc/x"} {
+		b, err := os.ReadFile(filepath.Join(root, p))
+		if err != nil || string(b) != "inside" {
+			t.Errorf("%s: got %q, %v", p, b, err)
+		}
+	}
+}
+
+func TestUnpackLayerWhiteouts(t *testing.T) {
+	root, _ := sandbox(t)
+	tr := layer(t,
+		entry{name: "d/", typ: tar.TypeDir},
+		entry{name: "d/a", typ: tar.TypeReg, body: "a"},
+		entry{name: "d/b", typ: tar.TypeReg, body: "b"},
+		entry{name: "e/", typ: tar.TypeDir},
+		entry{name: "e/c", typ: tar.TypeReg, body: "c"},
+		entry{name: "d/.wh.a", typ: tar.TypeReg},
+		entry{name: "e/.wh..wh..opq", typ: tar.TypeReg},
+		entry{name: "hl", typ: tar.TypeLink, link: "d/b"},
+	)
+	if err := unpackLayer(tr, root, rootlessOptions()); err != nil {
+		t.Fatal(err)
+	}
+	// whiteouts are stored in overlayfs form: a 0:0 character device for
+	// a removed entry and an xattr for an opaque directory
+	var st unix.Stat_t
+	if err := unix.Lstat(filepath.Join(root, "d/a"), &st); err != nil {
+		t.Fatalf("d/a: %v", err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFCHR || st.Rdev != 0 {
+		t.Errorf("d/a: want a 0:0 whiteout device, got mode %o rdev %d", st.Mode, st.Rdev)
+	}
+	buf := make([]byte, 1)
+	_, errTrusted := unix.Lgetxattr(filepath.Join(root, "e"), "trusted.overlay.opaque", buf)
+	_, errUser := unix.Lgetxattr(filepath.Join(root, "e"), "user.overlay.opaque", buf)
+	if errTrusted != nil && errUser != nil {
+		t.Errorf("e: not marked opaque: %v", errUser)
+	}
+	if b, err := os.ReadFile(filepath.Join(root, "e/c")); err != nil || string(b) != "c" {
+		t.Errorf("e/c: entries of the same layer must survive the opaque marker: %q, %v", b, err)
+	}
+	if b, err := os.ReadFile(filepath.Join(root, "hl")); err != nil || string(b) != "b" {
+		t.Errorf("hl: got %q, %v", b, err)
+	}
+}
+
+func TestUnpackLayerShiftsOwners(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to chown")
+	}
+	root, _ := sandbox(t)
+	tr := layer(t,
+		entry{name: "root", typ: tar.TypeReg},
+		entry{name: "user", typ: tar.TypeReg, uid: 1000, gid: 1000},
+		// beyond the 65536 ids of the range
+		entry{name: "unmapped", typ: tar.TypeReg, uid: 70000, gid: 70000},
+	)
+	maps := []syscall.SysProcIDMap{{ContainerID: 0, HostID: 100000, Size: 65536}}
+	if err := unpackLayer(tr, root, &PullOptions{UIDMap: maps, GIDMap: maps}); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]uint32{"root": 100000, "user": 101000, "unmapped": 100000 + 65534} {
+		var st unix.Stat_t
+		if err := unix.Lstat(filepath.Join(root, name), &st); err != nil {
+			t.Fatal(err)
+		}
+		if st.Uid != want || st.Gid != want {
+			t.Errorf("%s: owned by %d:%d, want %d:%d", name, st.Uid, st.Gid, want, want)
+		}
+	}
+}
+
+func TestUnpackLayerFailsOnOwnerItCannotSet(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can give files to anyone")
+	}
+	root, _ := sandbox(t)
+	// uid 1000 is not mapped and becomes the overflow id, which is not
+	// the caller's to give
+	tr := layer(t, entry{name: "user", typ: tar.TypeReg, uid: 1000, gid: 1000})
+	err := unpackLayer(tr, root, rootlessOptions())
+	if err == nil || !strings.Contains(err.Error(), "/etc/subuid") {
+		t.Errorf("got %v, want an error about subordinate ids", err)
+	}
+}
@@ -0,0 +1,124 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/alafilearnstocode/ccrun/internal/idmap"
+)
+
+// layerDir returns where a layer is unpacked under opts.LayersDir. Owners
+// are shifted at unpack time, so the same layer unpacked for different id
+// maps lives in different directories.
+func layerDir(digest string, opts *PullOptions) (string, error) {
+	digest = normalizeDigest(digest)
+	if !digestRE.MatchString(digest) {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	name := digest[len("sha256:"):]
+	if key := idMapKey(opts.UIDMap, opts.GIDMap); key != "" {
+		name += "-" + key
+	}
+	return filepath.Abs(filepath.Join(opts.LayersDir, "sha256", name))
+}
+
+// idMapKey is a short name for a pair of id maps; identity maps have none.
+func idMapKey(uidMap, gidMap []syscall.SysProcIDMap) string {
+	identity := func(maps []syscall.SysProcIDMap) bool {
+		for _, m := range maps {
+			if m.ContainerID != m.HostID {
+				return false
+			}
+		}
+		return true
+	}
+	if identity(uidMap) && identity(gidMap) {
+		return ""
+	}
+	h := sha256.New()
+	// v2: unmapped owners became the overflow id; layers unpacked
+	// before kept them as host ids and must not be reused
+	fmt.Fprintf(h, "v2 %v %v", uidMap, gidMap)
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// unpackLayerDir unpacks a layer from the blob store into its own
+// directory, unless that has been done before.
+func unpackLayerDir(l Layer, diffID string, opts *PullOptions) (string, error) {
+	dir, err := layerDir(l.Digest, opts)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(dir); err == nil {
+		dbg("layer %s: already unpacked", l.Digest)
+		return dir, nil
+	}
+
+	tmp := dir + ".partial"
+	if err := os.RemoveAll(tmp); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(tmp, 0o755); err != nil {
+		return "", err
+	}
+	unpack := opts.Unpack
+	if unpack == nil {
+		unpack = func(l Layer, diffID, dir string) error {
+			return UnpackLayer(l, diffID, dir, *opts)
+		}
+	}
+	if err := unpack(l, diffID, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	return dir, os.Rename(tmp, dir)
+}
+
+// UnpackLayer unpacks layer l from opts.Blobs into the existing
+// directory dir, which is given to the container's root. Owners are
+// shifted by opts.UIDMap and opts.GIDMap; opts.Unpack is not used.
+func UnpackLayer(l Layer, diffID, dir string, opts PullOptions) error {
+	if err := setOwner(dir, idmap.HostID(opts.UIDMap, 0), idmap.HostID(opts.GIDMap, 0), os.ModeDir|0o755); err != nil {
+		return err
+	}
+	return applyLayer(opts.Blobs, l, diffID, dir, &opts)
+}
+
+// ImageLayers returns the unpacked layer directories of the image Pull
+// stored in dest, bottom layer first. It fails with an error wrapping
+// os.ErrNotExist if the image or one of its layers is not available for
+// the id maps in opts, and with another error if the image is for a
+// platform other than opts.Platform.
+func ImageLayers(dest string, opts PullOptions) ([]string, error) {
+	if opts.Platform == (Platform{}) {
+		opts.Platform = DefaultPlatform()
+	}
+	if err := checkPlatform(dest, opts.Platform); err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(filepath.Join(dest, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	var mani Manifest
+	if err := json.Unmarshal(b, &mani); err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Join(dest, "manifest.json"), err)
+	}
+	var dirs []string
+	for _, l := range mani.Layers {
+		dir, err := layerDir(l.Digest, &opts)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(dir); err != nil {
+			return nil, fmt.Errorf("layer %s: %w", l.Digest, err)
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs, nil
+}
@@ -0,0 +1,96 @@
+package registry
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type compression int
+
+const (
+	uncompressed compression = iota
+	compressedGzip
+	compressedZstd
+)
+
+// layerCompression maps a layer's media type to how its blob is
+// compressed. Foreign and non-distributable layers, which registries
+// may not serve, and unknown types are refused.
+func layerCompression(mediaType string) (compression, error) {
+	switch mediaType {
+	case "application/vnd.oci.image.layer.v1.tar",
+		"application/vnd.docker.image.rootfs.diff.tar":
+		return uncompressed, nil
+	case "application/vnd.oci.image.layer.v1.tar+gzip",
+		"application/vnd.docker.image.rootfs.diff.tar.gzip":
+		return compressedGzip, nil
+	case "application/vnd.oci.image.layer.v1.tar+zstd":
+		return compressedZstd, nil
+	}
+	if strings.Contains(mediaType, ".foreign.") || strings.Contains(mediaType, ".nondistributable.") {
+		return 0, fmt.Errorf("foreign layer type %s is not supported", mediaType)
+	}
+	if mediaType == "" {
+		return 0, errors.New("layer has no media type")
+	}
+	return 0, fmt.Errorf("unsupported layer type %s", mediaType)
+}
+
+// decompress returns the uncompressed stream of a layer blob.
+func decompress(r io.Reader, c compression) (io.ReadCloser, error) {
+	switch c {
+	case compressedGzip:
+		return gzip.NewReader(r)
+	case compressedZstd:
+		return zstdReader(r)
+	default:
+		return io.NopCloser(r), nil
+	}
+}
+
+// zstdStream decodes a zstd stream in process. Like a gzip.Reader, it
+// fails reads of a corrupt or truncated stream; Close reports that
+// failure too.
+type zstdStream struct {
+	dec     *zstd.Decoder
+	readErr error
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func zstdReader(r io.Reader) (*zstdStream, error) {
+	// one layer is unpacked at a time; decoding on the caller's
+	// goroutine is fast enough and keeps memory use down
+	dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, fmt.Errorf("zstd: %w", err)
+	}
+	return &zstdStream{dec: dec}, nil
+}
+
+func (z *zstdStream) Read(p []byte) (int, error) {
+	n, err := z.dec.Read(p)
+	if err != nil && err != io.EOF && z.readErr == nil {
+		z.readErr = fmt.Errorf("zstd: %w", err)
+	}
+	return n, err
+}
+
+// Close decodes whatever the reader left, which tells whether the
+// stream was intact, and frees the decoder. Later calls return the
+// result of the first.
+func (z *zstdStream) Close() error {
+	z.closeOnce.Do(func() {
+		io.Copy(io.Discard, z)
+		z.dec.Close()
+		z.closeErr = z.readErr
+	})
+	return z.closeErr
+}
@@ -0,0 +1,94 @@
+package registry
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/alafilearnstocode/ccrun/internal/idmap"
+	"github.com/alafilearnstocode/ccrun/internal/rootfs"
+	"golang.org/x/sys/unix"
+)
+
+const paxXattrPrefix = "SCHILY.xattr."
+
+// setOwner is rootfs.SetOwner. An owner that the caller may not give
+// files to is an error rather than skipped: the layer would claim a
+// shift that was never applied.
+func setOwner(full string, uid, gid int, mode os.FileMode) error {
+	err := rootfs.SetOwner(full, uid, gid, mode)
+	if errors.Is(err, unix.EPERM) || errors.Is(err, unix.EINVAL) {
+		return fmt.Errorf("%w (cannot give files to %d:%d; rootless pulls need a subordinate id range for the user in /etc/subuid and /etc/subgid)", err, uid, gid)
+	}
+	return err
+}
+
+// mkdirAll is os.MkdirAll for directories that no tar entry describes.
+// They are owned by the container's root rather than the host's.
+func mkdirAll(p string, opts *PullOptions) error {
+	fi, err := os.Stat(p)
+	if err == nil {
+		if !fi.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: p, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	if err := mkdirAll(filepath.Dir(p), opts); err != nil {
+		return err
+	}
+	if err := os.Mkdir(p, 0o755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return setOwner(p, idmap.HostID(opts.UIDMap, 0), idmap.HostID(opts.GIDMap, 0), os.ModeDir|0o755)
+}
+
+// applyMetadata restores ownership, permission bits, xattrs and times
+// from hdr. Xattrs outside the user namespace cannot be set without root
+// on the host, which root in a user namespace is not; those failures
+// are ignored.
+func applyMetadata(full string, hdr *tar.Header, opts *PullOptions) error {
+	if err := setOwner(full, idmap.HostID(opts.UIDMap, hdr.Uid), idmap.HostID(opts.GIDMap, hdr.Gid), hdr.FileInfo().Mode()); err != nil {
+		return err
+	}
+
+	for name, value := range xattrs(hdr) {
+		if err := unix.Lsetxattr(full, name, []byte(value), 0); err != nil {
+			if errors.Is(err, unix.ENOTSUP) || (errors.Is(err, unix.EPERM) && !strings.HasPrefix(name, "user.")) {
+				dbg("skip xattr %s on %s: %v", name, hdr.Name, err)
+				continue
+			}
+			return err
+		}
+	}
+
+	if hdr.Typeflag == tar.TypeDir {
+		return nil
+	}
+	return restoreTimes(full, hdr)
+}
+
+func xattrs(hdr *tar.Header) map[string]string {
+	out := map[string]string{}
+	for k, v := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(k, paxXattrPrefix); ok {
+			out[name] = v
+		}
+	}
+	return out
+}
+
+func restoreTimes(full string, hdr *tar.Header) error {
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(atime.UnixNano()),
+		unix.NsecToTimespec(hdr.ModTime.UnixNano()),
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, full, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -0,0 +1,171 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Platform is an image's operating system and CPU architecture, as in
+// the platform entries of a manifest list.
+type Platform struct {
+	OS           string
+	Architecture string
+	Variant      string // e.g. v7 for arm; often empty
+}
+
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// normalize maps the spellings that are used for the same platform to
+// one, the way containerd does.
+func (p Platform) normalize() Platform {
+	p.OS = strings.ToLower(p.OS)
+	p.Architecture = strings.ToLower(p.Architecture)
+	p.Variant = strings.ToLower(p.Variant)
+	switch p.Architecture {
+	case "x86_64", "x86-64":
+		p.Architecture = "amd64"
+	case "i386":
+		p.Architecture = "386"
+	case "aarch64":
+		p.Architecture = "arm64"
+	case "armhf":
+		p.Architecture, p.Variant = "arm", "v7"
+	case "armel":
+		p.Architecture, p.Variant = "arm", "v6"
+	}
+	switch {
+	case p.Architecture == "arm64" && p.Variant == "v8":
+		p.Variant = ""
+	case p.Architecture == "arm" && p.Variant == "":
+		p.Variant = "v7"
+	case p.Architecture == "arm" && len(p.Variant) == 1:
+		p.Variant = "v" + p.Variant
+	}
+	return p
+}
+
+// ParsePlatform parses os/arch[/variant], e.g. linux/amd64 or
+// linux/arm/v7.
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("invalid platform %q: want os/arch[/variant]", s)
+	}
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p.normalize(), nil
+}
+
+// DefaultPlatform is the platform ccrun itself was built for, which is
+// the one whose binaries this machine can run.
+func DefaultPlatform() Platform {
+	p := Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	if p.Architecture == "arm" {
+		if bi, ok := debug.ReadBuildInfo(); ok {
+			for _, s := range bi.Settings {
+				if s.Key == "GOARM" {
+					p.Variant = "v" + strings.TrimSuffix(strings.TrimSuffix(s.Value, ",softfloat"), ",hardfloat")
+				}
+			}
+		}
+	}
+	return p.normalize()
+}
+
+// compatible lists the platforms whose images run on p, best first: an
+// arm v7 machine also runs v6 and v5 binaries.
+func (p Platform) compatible() []Platform {
+	p = p.normalize()
+	out := []Platform{p}
+	if p.Architecture == "arm" {
+		for _, v := range []string{"v7", "v6", "v5"} {
+			if v < p.Variant {
+				out = append(out, Platform{OS: p.OS, Architecture: p.Architecture, Variant: v})
+			}
+		}
+	}
+	return out
+}
+
+// runsOn reports whether an image for p runs on want.
+func (p Platform) runsOn(want Platform) bool {
+	p = p.normalize()
+	for _, c := range want.compatible() {
+		if p == c {
+			return true
+		}
+	}
+	return false
+}
+
+// selectManifest picks the entry of a manifest list that best suits
+// want, and returns its digest and platform.
+func selectManifest(ml *ManifestList, want Platform) (string, Platform, error) {
+	var available []string
+	for _, c := range want.compatible() {
+		for _, m := range ml.Manifests {
+			p := Platform{OS: m.Platform.OS, Architecture: m.Platform.Architecture, Variant: m.Platform.Variant}.normalize()
+			if p == c {
+				return m.Digest, p, nil
+			}
+		}
+	}
+	for _, m := range ml.Manifests {
+		// attestation manifests have platform unknown/unknown
+		if m.Platform.OS != "unknown" {
+			available = append(available, Platform{OS: m.Platform.OS, Architecture: m.Platform.Architecture, Variant: m.Platform.Variant}.String())
+		}
+	}
+	return "", Platform{}, fmt.Errorf("no image for %s in manifest list (available: %s)", want, strings.Join(available, ", "))
+}
+
+// platformFile records next to an image which platform it was pulled
+// for.
+const platformFile = "platform"
+
+// ImagePlatform returns the platform of the image Pull stored in dest.
+// Images pulled before platforms were recorded fall back to their
+// config.
+func ImagePlatform(dest string) (Platform, error) {
+	b, err := os.ReadFile(filepath.Join(dest, platformFile))
+	if err == nil {
+		return ParsePlatform(strings.TrimSpace(string(b)))
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return Platform{}, err
+	}
+	cfg, err := LoadImageConfig(filepath.Join(dest, "config.json"))
+	if err != nil {
+		return Platform{}, err
+	}
+	return Platform{OS: cfg.OS, Architecture: cfg.Architecture, Variant: cfg.Variant}.normalize(), nil
+}
+
+// checkPlatform fails if dest holds an image for a platform other than
+// want.
+func checkPlatform(dest string, want Platform) error {
+	if _, err := os.Stat(filepath.Join(dest, "manifest.json")); err != nil {
+		return nil
+	}
+	have, err := ImagePlatform(dest)
+	if err != nil {
+		return err
+	}
+	if !have.runsOn(want) {
+		return fmt.Errorf("%s holds an image for %s, not %s; remove it or use --platform %s", dest, have, want.normalize(), have)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package registry
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSelectManifest(t *testing.T) {
+	var ml ManifestList
+	json.Unmarshal([]byte(`{"manifests": [
+		{"digest": "arm64", "platform": {"os": "linux", "architecture": "arm64", "variant": "v8"}},
+		{"digest": "amd64", "platform": {"os": "linux", "architecture": "amd64"}},
+		{"digest": "armv6", "platform": {"os": "linux", "architecture": "arm", "variant": "v6"}},
+		{"digest": "attestation", "platform": {"os": "unknown", "architecture": "unknown"}}
+	]}`), &ml)
+
+	tests := []struct {
+		platform string
+		want     string
+	}{
+		{"linux/amd64", "amd64"},
+		{"linux/x86_64", "amd64"},
+		{"linux/arm64", "arm64"},
+		{"linux/aarch64/v8", "arm64"},
+		{"linux/arm/v7", "armv6"}, // v7 runs v6 binaries
+		{"linux/arm/v5", ""},
+		{"linux/s390x", ""},
+		{"windows/amd64", ""},
+	}
+	for _, tt := range tests {
+		p, err := ParsePlatform(tt.platform)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _, err := selectManifest(&ml, p)
+		if got != tt.want || (err == nil) != (tt.want != "") {
+			t.Errorf("%s: got %q, %v; want %q", tt.platform, got, err, tt.want)
+		}
+		if err != nil && strings.Contains(err.Error(), "unknown") {
+			t.Errorf("%s: error lists attestation manifests: %v", tt.platform, err)
+		}
+	}
+
+	for _, bad := range []string{"linux", "linux/", "/amd64", "linux/arm/v7/x"} {
+		if _, err := ParsePlatform(bad); err == nil {
+			t.Errorf("ParsePlatform(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestPullRefusesToMixPlatforms(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.addImage(t, "v1", []entry{{name: "a", typ: tar.TypeReg, body: "a"}})
+	ref, err := ParseImageRef(strings.TrimPrefix(reg.URL, "http://") + "/team/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	opts := testPullOptions(t)
+
+	arm := opts
+	arm.Platform = Platform{OS: "linux", Architecture: "arm64"}
+	if err := Pull(ref, dest, arm); err == nil || !strings.Contains(err.Error(), "linux/amd64, not linux/arm64") {
+		t.Fatalf("pulling an amd64-only image for arm64: got %v", err)
+	}
+
+	if err := Pull(ref, dest, opts); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := ImagePlatform(dest); err != nil || p.String() != "linux/amd64" {
+		t.Errorf("recorded platform: %v, %v", p, err)
+	}
+	if _, err := ImageLayers(dest, opts); err != nil {
+		t.Error(err)
+	}
+	if _, err := ImageLayers(dest, arm); err == nil {
+		t.Error("ImageLayers returned amd64 layers for arm64")
+	}
+	if err := Pull(ref, dest, arm); err == nil {
+		t.Error("pulling arm64 over an amd64 image succeeded")
+	}
+}
@@ -0,0 +1,68 @@
+package registry
+
+import (
+	"io"
+	"time"
+)
+
+// Layer states reported through Progress, in the order a layer goes
+// through them. A layer whose blob is already in the store goes straight
+// from waiting to cached.
+const (
+	StatusWaiting     = "waiting"
+	StatusDownloading = "downloading"
+	StatusDownloaded  = "downloaded"
+	StatusCached      = "cached"
+	StatusExtracting  = "extracting"
+	StatusDone        = "done"
+	StatusFailed      = "failed"
+)
+
+// ProgressEvent describes the state of one layer during a pull.
+type ProgressEvent struct {
+	Layer   string `json:"layer"` // digest
+	Status  string `json:"status"`
+	Current int64  `json:"current"` // bytes downloaded so far
+	Total   int64  `json:"total"`   // size from the manifest
+	Error   string `json:"error,omitempty"`
+}
+
+// Progress receives events while Pull runs. Layers are downloaded in
+// parallel, so Update may be called from several goroutines at once.
+type Progress interface {
+	Update(ProgressEvent)
+}
+
+// progressInterval limits how often byte counts are reported per layer.
+const progressInterval = 100 * time.Millisecond
+
+func (o *PullOptions) report(l Layer, status string, current int64) {
+	if o.Progress != nil {
+		o.Progress.Update(ProgressEvent{Layer: normalizeDigest(l.Digest), Status: status, Current: current, Total: l.Size})
+	}
+}
+
+func (o *PullOptions) reportError(l Layer, err error) {
+	if o.Progress != nil {
+		o.Progress.Update(ProgressEvent{Layer: normalizeDigest(l.Digest), Status: StatusFailed, Total: l.Size, Error: err.Error()})
+	}
+}
+
+// progressReader counts the bytes read through it and hands the running
+// total, starting at n, to fn at most every progressInterval.
+type progressReader struct {
+	r    io.Reader
+	n    int64
+	last time.Time
+	fn   func(int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		p.fn(p.n)
+	}
+	return n, err
+}
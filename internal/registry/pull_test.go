@@ -0,0 +1,314 @@
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// fakeRegistry serves the manifests and blobs it is given over plain
+// HTTP, like a registry on localhost:5000.
+type fakeRegistry struct {
+	*httptest.Server
+	manifests map[string][]byte // by tag and digest
+	types     map[string]string // content type by tag and digest
+	blobs     map[string][]byte
+
+	// gate, if set, sees every request first and may answer it itself.
+	gate func(w http.ResponseWriter, req *http.Request) bool
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	r := &fakeRegistry{manifests: map[string][]byte{}, types: map[string]string{}, blobs: map[string][]byte{}}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *fakeRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	if r.gate != nil && r.gate(w, req) {
+		return
+	}
+	p := req.URL.Path
+	switch {
+	case p == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case strings.Contains(p, "/manifests/"):
+		ref := p[strings.LastIndex(p, "/")+1:]
+		b, ok := r.manifests[ref]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", r.types[ref])
+		w.Write(b)
+	case strings.Contains(p, "/blobs/"):
+		b, ok := r.blobs[p[strings.LastIndex(p, "/")+1:]]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write(b)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func digestOf(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func (r *fakeRegistry) addBlob(b []byte) string {
+	d := digestOf(b)
+	r.blobs[d] = b
+	return d
+}
+
+// addImage stores an image with one gzipped layer per entry list under
+// tag and returns the manifest's digest.
+func (r *fakeRegistry) addImage(t *testing.T, tag string, layers ...[]entry) string {
+	return r.addImageOf(t, tag, "application/vnd.oci.image.layer.v1.tar+gzip", layers...)
+}
+
+// addImageOf adds an image whose layers are compressed as mediaType says.
+func (r *fakeRegistry) addImageOf(t *testing.T, tag, mediaType string, layers ...[]entry) string {
+	t.Helper()
+	mani := map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+	}
+	var ls []map[string]any
+	var diffIDs []string
+	for _, es := range layers {
+		tb := layerTar(t, es...)
+		diffIDs = append(diffIDs, digestOf(tb))
+		blob := compressLayer(t, tb, mediaType)
+		ls = append(ls, map[string]any{
+			"mediaType": mediaType,
+			"digest":    r.addBlob(blob),
+			"size":      len(blob),
+		})
+	}
+	cfg, _ := json.Marshal(map[string]any{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config":       map[string]any{"Cmd": []string{"/bin/sh"}},
+		"rootfs":       map[string]any{"type": "layers", "diff_ids": diffIDs},
+	})
+	mani["config"] = map[string]any{
+		"mediaType": "application/vnd.oci.image.config.v1+json",
+		"digest":    r.addBlob(cfg),
+		"size":      len(cfg),
+	}
+	mani["layers"] = ls
+	b, err := json.Marshal(mani)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := digestOf(b)
+	for _, ref := range []string{tag, d} {
+		r.manifests[ref] = b
+		r.types[ref] = "application/vnd.oci.image.manifest.v1+json"
+	}
+	return d
+}
+
+func compressLayer(t *testing.T, tb []byte, mediaType string) []byte {
+	t.Helper()
+	switch {
+	case strings.HasSuffix(mediaType, "gzip"):
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(tb)
+		gz.Close()
+		return buf.Bytes()
+	case strings.HasSuffix(mediaType, "zstd"):
+		var buf bytes.Buffer
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zw.Write(tb)
+		zw.Close()
+		return buf.Bytes()
+	}
+	return tb
+}
+
+func testPullOptions(t *testing.T) PullOptions {
+	dir := t.TempDir()
+	opts := rootlessOptions()
+	opts.Blobs = NewBlobStore(filepath.Join(dir, "blobs"))
+	opts.LayersDir = filepath.Join(dir, "layers")
+	opts.Platform = Platform{OS: "linux", Architecture: "amd64"}
+	return *opts
+}
+
+func TestPullFromLocalRegistry(t *testing.T) {
+	reg := newFakeRegistry(t)
+	digest := reg.addImage(t, "v1",
+		[]entry{{name: "etc/", typ: tar.TypeDir}, {name: "etc/os-release", typ: tar.TypeReg, body: "test"}},
+		[]entry{{name: "etc/os-release", typ: tar.TypeReg, body: "test 2"}},
+	)
+	host := strings.TrimPrefix(reg.URL, "http://")
+
+	for _, s := range []string{host + "/team/app:v1", host + "/team/app@" + digest, host + "/team/app:v1@" + digest} {
+		ref, err := ParseImageRef(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := testPullOptions(t)
+		dest := filepath.Join(t.TempDir(), "image")
+		if err := Pull(ref, dest, opts); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		layers, err := ImageLayers(dest, opts)
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		if len(layers) != 2 {
+			t.Fatalf("%s: got %d layers, want 2", s, len(layers))
+		}
+		if b, err := os.ReadFile(filepath.Join(layers[1], "etc/os-release")); err != nil || string(b) != "test 2" {
+			t.Errorf("%s: top layer: %q, %v", s, b, err)
+		}
+		if !IsImageDir(dest) {
+			t.Errorf("%s: IsImageDir(%s) = false", s, dest)
+		}
+	}
+}
+
+func TestIsImageDirIgnoresBundle(t *testing.T) {
+	// an OCI bundle: a runtime spec next to its rootfs
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"ociVersion":"1.0.2"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if IsImageDir(dir) {
+		t.Error("bundle taken for an image")
+	}
+}
+
+func TestPullRejectsWrongManifestDigest(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.addImage(t, "v1", []entry{{name: "a", typ: tar.TypeReg, body: "a"}})
+	other := "sha256:" + strings.Repeat("0", 64)
+	reg.manifests[other] = reg.manifests["v1"]
+	reg.types[other] = reg.types["v1"]
+
+	ref, err := ParseImageRef(strings.TrimPrefix(reg.URL, "http://") + "/team/app@" + other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Pull(ref, t.TempDir(), testPullOptions(t)); err == nil {
+		t.Fatal("pull succeeded with a manifest that does not match the digest")
+	}
+}
+
+func TestPullLayerMediaTypes(t *testing.T) {
+	for _, mt := range []string{
+		"application/vnd.oci.image.layer.v1.tar",
+		"application/vnd.oci.image.layer.v1.tar+gzip",
+		"application/vnd.oci.image.layer.v1.tar+zstd",
+		"application/vnd.docker.image.rootfs.diff.tar.gzip",
+	} {
+		t.Run(mt, func(t *testing.T) {
+			reg := newFakeRegistry(t)
+			reg.addImageOf(t, "v1", mt, []entry{{name: "a", typ: tar.TypeReg, body: "layer"}})
+			ref, err := ParseImageRef(strings.TrimPrefix(reg.URL, "http://") + "/team/app:v1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := testPullOptions(t)
+			dest := t.TempDir()
+			if err := Pull(ref, dest, opts); err != nil {
+				t.Fatal(err)
+			}
+			layers, err := ImageLayers(dest, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b, err := os.ReadFile(filepath.Join(layers[0], "a")); err != nil || string(b) != "layer" {
+				t.Errorf("a: %q, %v", b, err)
+			}
+		})
+	}
+
+	for _, mt := range []string{
+		"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip",
+		"application/vnd.oci.image.layer.nondistributable.v1.tar+gzip",
+		"application/vnd.example.layer.v1.tar+lz4",
+	} {
+		t.Run(mt, func(t *testing.T) {
+			reg := newFakeRegistry(t)
+			reg.addImageOf(t, "v1", mt, []entry{{name: "a", typ: tar.TypeReg, body: "layer"}})
+			ref, err := ParseImageRef(strings.TrimPrefix(reg.URL, "http://") + "/team/app:v1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = Pull(ref, t.TempDir(), testPullOptions(t))
+			if err == nil || !strings.Contains(err.Error(), mt) {
+				t.Errorf("got %v, want an error naming the layer type", err)
+			}
+		})
+	}
+}
+
+func TestApplyLayerVerifiesDiffID(t *testing.T) {
+	opts := testPullOptions(t)
+	tb := layerTar(t, entry{name: "a", typ: tar.TypeReg, body: "a"})
+	blob := compressLayer(t, tb, "gzip")
+	digest, err := opts.Blobs.PutBytes(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := Layer{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip", Digest: digest, Size: int64(len(blob))}
+
+	if err := applyLayer(opts.Blobs, l, digestOf(tb), t.TempDir(), &opts); err != nil {
+		t.Fatal(err)
+	}
+	// the compressed digest is not the diff_id
+	if err := applyLayer(opts.Blobs, l, digest, t.TempDir(), &opts); err == nil || !strings.Contains(err.Error(), "diff_id") {
+		t.Errorf("got %v, want a diff_id mismatch", err)
+	}
+}
+
+func TestZstdReaderCloseTwice(t *testing.T) {
+	blob := compressLayer(t, []byte("data"), "zstd")
+	z, err := zstdReader(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(z); err != nil || string(b) != "data" {
+		t.Fatalf("got %q, %v", b, err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+
+	// a truncated stream fails on every Close
+	z, err = zstdReader(bytes.NewReader(blob[:len(blob)/2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(z)
+	if err1, err2 := z.Close(), z.Close(); err1 == nil || err2 != err1 {
+		t.Errorf("truncated stream: Close returned %v, then %v", err1, err2)
+	}
+}
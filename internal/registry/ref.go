@@ -0,0 +1,155 @@
+package registry
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultDomain = "docker.io"
+	// Docker Hub's API is not served from docker.io itself.
+	dockerHubRegistry = "registry-1.docker.io"
+	maxNameLength     = 255
+)
+
+var (
+	// one path component of a repository name, e.g. "alpine" or "my_app-2"
+	pathComponentRE = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+	// a host name or IPv4 address, or a bracketed IPv6 address, with an
+	// optional port
+	domainRE = regexp.MustCompile(`^(?:(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])(?:\.(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9]))*|\[[a-fA-F0-9:]+\])(?::[0-9]+)?$`)
+	tagRE    = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+)
+
+// ImageRef is a parsed image reference such as alpine,
+// docker.io/library/alpine:3.19 or localhost:5000/team/app@sha256:....
+type ImageRef struct {
+	Domain   string // as written, e.g. docker.io or localhost:5000
+	Registry string // host serving the registry API, e.g. registry-1.docker.io
+	Repo     string // e.g. library/alpine
+	Tag      string // empty if only a digest was given
+	Digest   string // e.g. sha256:...; takes precedence over Tag
+
+	// plainHTTP is set by Pull for registries that only speak HTTP.
+	plainHTTP bool
+}
+
+func (r ImageRef) String() string {
+	s := r.Domain + "/" + r.Repo
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// RepoPath is the repository's path below the images directory. Docker
+// Hub repositories are stored without their domain.
+func (r ImageRef) RepoPath() string {
+	if r.Domain == defaultDomain {
+		return r.Repo
+	}
+	return r.Domain + "/" + r.Repo
+}
+
+// Reference is what the manifest is requested by: the digest if there is
+// one, else the tag.
+func (r ImageRef) Reference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+func (r ImageRef) baseURL() string {
+	if r.plainHTTP {
+		return "http://" + r.Registry
+	}
+	return "https://" + r.Registry
+}
+
+// ParseImageRef parses an image reference the way docker does: the first
+// path component is a registry domain if it contains a dot or a colon or
+// is "localhost", and otherwise the image is on Docker Hub, where
+// single-component names live under library/. Without a tag or digest,
+// the tag is latest.
+func ParseImageRef(s string) (ImageRef, error) {
+	bad := func(why string) (ImageRef, error) {
+		return ImageRef{}, fmt.Errorf("invalid reference %q: %s", s, why)
+	}
+	if s == "" {
+		return bad("empty")
+	}
+
+	var ref ImageRef
+	name := s
+	if i := strings.LastIndexByte(name, '@'); i >= 0 {
+		name, ref.Digest = name[:i], name[i+1:]
+		if !digestRE.MatchString(ref.Digest) {
+			return bad("digest must be sha256:<64 hex digits>")
+		}
+	}
+	if i := strings.LastIndexByte(name, ':'); i > strings.LastIndexByte(name, '/') {
+		name, ref.Tag = name[:i], name[i+1:]
+		if !tagRE.MatchString(ref.Tag) {
+			return bad("invalid tag")
+		}
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+
+	ref.Domain, ref.Repo = defaultDomain, name
+	if first, rest, ok := strings.Cut(name, "/"); ok &&
+		(strings.ContainsAny(first, ".:") || first == "localhost" || strings.ToLower(first) != first) {
+		ref.Domain, ref.Repo = first, rest
+	}
+	if !domainRE.MatchString(ref.Domain) {
+		return bad("invalid registry domain")
+	}
+	if ref.Domain == "index.docker.io" {
+		ref.Domain = defaultDomain
+	}
+	if ref.Domain == defaultDomain && !strings.Contains(ref.Repo, "/") {
+		ref.Repo = "library/" + ref.Repo
+	}
+
+	if ref.Repo == "" {
+		return bad("missing repository name")
+	}
+	for _, c := range strings.Split(ref.Repo, "/") {
+		if !pathComponentRE.MatchString(c) {
+			if strings.ToLower(c) != c {
+				return bad("repository name must be lowercase")
+			}
+			return bad("invalid repository name")
+		}
+	}
+	if len(ref.Domain)+1+len(ref.Repo) > maxNameLength {
+		return bad(fmt.Sprintf("name longer than %d characters", maxNameLength))
+	}
+
+	ref.Registry = ref.Domain
+	if ref.Domain == defaultDomain {
+		ref.Registry = dockerHubRegistry
+	}
+	return ref, nil
+}
+
+// isLoopback reports whether a registry host:port is on this machine.
+func isLoopback(registry string) bool {
+	host := registry
+	if h, _, err := net.SplitHostPort(registry); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,80 @@
+package registry
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseImageRef(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	tests := []struct {
+		in                                  string
+		domain, registry, repo, tag, digest string
+	}{
+		{in: "alpine", domain: "docker.io", registry: "registry-1.docker.io", repo: "library/alpine", tag: "latest"},
+		{in: "alpine:3.19", domain: "docker.io", registry: "registry-1.docker.io", repo: "library/alpine", tag: "3.19"},
+		{in: "bitnami/redis:7", domain: "docker.io", registry: "registry-1.docker.io", repo: "bitnami/redis", tag: "7"},
+		{in: "docker.io/alpine", domain: "docker.io", registry: "registry-1.docker.io", repo: "library/alpine", tag: "latest"},
+		{in: "index.docker.io/library/alpine", domain: "docker.io", registry: "registry-1.docker.io", repo: "library/alpine", tag: "latest"},
+		{in: "ghcr.io/org/team/app:v1.2", domain: "ghcr.io", registry: "ghcr.io", repo: "org/team/app", tag: "v1.2"},
+		{in: "localhost/app", domain: "localhost", registry: "localhost", repo: "app", tag: "latest"},
+		{in: "localhost:5000/foo", domain: "localhost:5000", registry: "localhost:5000", repo: "foo", tag: "latest"},
+		{in: "localhost:5000/foo:dev", domain: "localhost:5000", registry: "localhost:5000", repo: "foo", tag: "dev"},
+		{in: "10.0.0.1:5000/a/b", domain: "10.0.0.1:5000", registry: "10.0.0.1:5000", repo: "a/b", tag: "latest"},
+		{in: "[::1]:5000/a", domain: "[::1]:5000", registry: "[::1]:5000", repo: "a", tag: "latest"},
+		{in: "alpine@" + digest, domain: "docker.io", registry: "registry-1.docker.io", repo: "library/alpine", digest: digest},
+		{in: "alpine:3.19@" + digest, domain: "docker.io", registry: "registry-1.docker.io", repo: "library/alpine", tag: "3.19", digest: digest},
+		{in: "reg.example.com:443/x/y@" + digest, domain: "reg.example.com:443", registry: "reg.example.com:443", repo: "x/y", digest: digest},
+		{in: "my_app__x/a-b.c", domain: "docker.io", registry: "registry-1.docker.io", repo: "my_app__x/a-b.c", tag: "latest"},
+	}
+	for _, tt := range tests {
+		ref, err := ParseImageRef(tt.in)
+		if err != nil {
+			t.Errorf("%s: %v", tt.in, err)
+			continue
+		}
+		if ref.Domain != tt.domain || ref.Registry != tt.registry || ref.Repo != tt.repo || ref.Tag != tt.tag || ref.Digest != tt.digest {
+			t.Errorf("%s: got %+v", tt.in, ref)
+		}
+	}
+}
+
+func TestParseImageRefInvalid(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"Alpine",
+		"alpine:",
+		"alpine:-x",
+		"alpine@sha256:abc",
+		"alpine@md5:" + strings.Repeat("a", 32),
+		"a//b",
+		"a/",
+		"-a",
+		"a..b",
+		"localhost:5000/",
+		"bad_domain.com:x/a",
+		"docker.io/" + strings.Repeat("a", 250),
+	} {
+		if ref, err := ParseImageRef(in); err == nil {
+			t.Errorf("%q: parsed as %+v, want error", in, ref)
+		}
+	}
+}
+
+func TestImageRefPaths(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	for in, want := range map[string]string{
+		"alpine:3.19":               "library/alpine 3.19",
+		"localhost:5000/foo":        "localhost:5000/foo latest",
+		"alpine:3.19@" + digest:     "library/alpine " + digest,
+		"ghcr.io/org/app@" + digest: "ghcr.io/org/app " + digest,
+	} {
+		ref, err := ParseImageRef(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ref.RepoPath() + " " + ref.Reference(); got != want {
+			t.Errorf("%s: got %q, want %q", in, got, want)
+		}
+	}
+}
@@ -2,29 +2,35 @@ package registry
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"bufio"
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
 	"os"
-	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
 )
 
+// dbg traces registry traffic on stderr, keeping stdout free for
+// --progress=json.
 func dbg(format string, args ...any) {
 	if os.Getenv("CCRUN_HTTP_DEBUG") == "1" {
-		fmt.Printf("[ccrun] "+format+"\n", args...)
+		fmt.Fprintf(os.Stderr, "[ccrun] "+format+"\n", args...)
 	}
 }
 
+// transport carries all registry requests; tests point it at a local
+// server.
+var transport http.RoundTripper = http.DefaultTransport
+
 func authClient() *http.Client {
 	return &http.Client{
+		Transport: transport,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			if len(via) > 0 {
 				prev := via[0]
@@ -66,29 +72,6 @@ func normalizeDigest(d string) string {
 	return d
 }
 
-type ImageRef struct {
-	Registry string // e.g. registry-1.docker.io
-	Repo     string // e.g. library/alpine
-	Tag      string // e.g. latest
-}
-
-func (r ImageRef) String() string   { return r.Repo + ":" + r.Tag }
-func (r ImageRef) RepoPath() string { return r.Repo }
-
-func ParseImageRef(s string) (ImageRef, error) {
-	// defaults: docker.io/library/<name>:latest
-	tag := "latest"
-	name := s
-	if i := strings.LastIndexByte(s, ':'); i > 0 && !strings.Contains(s[i+1:], "/") {
-		name = s[:i]
-		tag = s[i+1:]
-	}
-	if !strings.Contains(name, "/") {
-		name = "library/" + name
-	}
-	return ImageRef{Registry: "registry-1.docker.io", Repo: name, Tag: tag}, nil
-}
-
 type Manifest struct {
 	SchemaVersion int    `json:"schemaVersion"`
 	MediaType     string `json:"mediaType"`
@@ -120,279 +103,343 @@ type ManifestList struct {
 	} `json:"manifests"`
 }
 
-func Pull(ref ImageRef, dest string) error {
+// PullOptions controls how layers are unpacked.
+type PullOptions struct {
+	// UIDMap and GIDMap shift file owners from the image into the host
+	// ids they will have inside the container's user namespace. IDs not
+	// covered by the maps become the container's overflow id (65534),
+	// or the host's if that is not mapped either. Without maps, owners
+	// are kept as they are. Unpacking fails if an owner cannot be set.
+	UIDMap []syscall.SysProcIDMap
+	GIDMap []syscall.SysProcIDMap
+
+	// Unpack, if set, unpacks a layer into dir in place of UnpackLayer.
+	// Rootless callers use it to unpack inside a user namespace with
+	// the maps, where the shifted owners can be set.
+	Unpack func(l Layer, diffID, dir string) error
+
+	// Blobs caches manifests, configs and layers across pulls. Blobs
+	// already in the store are not downloaded again.
+	Blobs *BlobStore
+
+	// LayersDir holds every layer unpacked into its own directory, to
+	// be stacked with overlayfs. Layers are shared by all images.
+	LayersDir string
+
+	// MaxConcurrentDownloads bounds how many layers are downloaded at
+	// once. Zero means DefaultMaxConcurrentDownloads.
+	MaxConcurrentDownloads int
+
+	// Progress, if set, is told about every layer's download and
+	// extraction.
+	Progress Progress
+
+	// Credentials for the image's registry; nil pulls anonymously.
+	Credentials *Credentials
+
+	// LookupCredentials, if set and Credentials is nil, is called for
+	// them when the registry first asks for authentication, so that
+	// pulls that need none never run a credential helper. If it fails,
+	// the pull goes on anonymously.
+	LookupCredentials func() (*Credentials, error)
+
+	// Platform selects the image from a manifest list. The zero value
+	// means DefaultPlatform.
+	Platform Platform
+}
+
+const DefaultMaxConcurrentDownloads = 3
+
+// Pull fetches an image into the blob store and unpacks its layers.
+// dest receives the image's manifest.json and config.json; see
+// ImageLayers for the layer directories.
+func Pull(ref ImageRef, dest string, opts PullOptions) error {
+	if opts.Blobs == nil || opts.LayersDir == "" {
+		return fmt.Errorf("pull %s: no blob store or layers directory", ref)
+	}
+	platform := opts.Platform
+	if platform == (Platform{}) {
+		platform = DefaultPlatform()
+	}
+	// an image directory holds one platform's image; never swap it
+	// under containers that expect another
+	if err := checkPlatform(dest, platform); err != nil {
+		return err
+	}
 	if err := os.MkdirAll(dest, 0o755); err != nil {
 		return err
 	}
 
-	token, err := getToken(ref)
+	auth := newAuthorizer(ref, opts.Credentials)
+	if opts.Credentials == nil {
+		auth.lookup = opts.LookupCredentials
+	}
+	ref, err := ping(ref, auth)
 	if err != nil {
 		return err
 	}
 
-	mani, rawConfig, err := getManifestAndConfig(ref, token)
+	mani, rawManifest, rawConfig, err := getManifestAndConfig(ref, auth, opts.Blobs, platform)
 	if err != nil {
 		return err
 	}
-
-	rootfsDir := filepath.Join(dest, "rootfs")
-	if err := os.MkdirAll(rootfsDir, 0o755); err != nil {
+	cfg, err := ParseImageConfig(rawConfig)
+	if err != nil {
 		return err
 	}
+	// single-platform manifests say nothing about their platform; the
+	// config does
+	got := Platform{OS: cfg.OS, Architecture: cfg.Architecture, Variant: cfg.Variant}.normalize()
+	if !got.runsOn(platform) {
+		return fmt.Errorf("%s is an image for %s, not %s", ref, got, platform)
+	}
+	// refuse layers that cannot be unpacked before downloading any
+	if len(cfg.RootFS.DiffIDs) != len(mani.Layers) {
+		return fmt.Errorf("%s: config lists %d diff_ids for %d layers", ref, len(cfg.RootFS.DiffIDs), len(mani.Layers))
+	}
+	for i, l := range mani.Layers {
+		if _, err := layerCompression(l.MediaType); err != nil {
+			return fmt.Errorf("layer %d %s: %w", i, l.Digest, err)
+		}
+	}
 
+	// Layers are downloaded in parallel but unpacked one at a time in
+	// manifest order, each as soon as it and its predecessors are in.
+	for _, l := range mani.Layers {
+		opts.report(l, StatusWaiting, 0)
+	}
+	fetched := fetchLayers(ref, auth, mani.Layers, &opts)
+	defer fetched.stop()
 	for i, l := range mani.Layers {
-		if err := fetchAndApplyLayer(ref, token, normalizeDigest(l.Digest), rootfsDir); err != nil {
+		err := <-fetched.done[i]
+		if err == nil {
+			opts.report(l, StatusExtracting, l.Size)
+			_, err = unpackLayerDir(l, cfg.RootFS.DiffIDs[i], &opts)
+		}
+		if err != nil {
+			opts.reportError(l, err)
 			return fmt.Errorf("layer %d %s: %w", i, l.Digest, err)
 		}
+		opts.report(l, StatusDone, l.Size)
 	}
 
 	if err := os.WriteFile(filepath.Join(dest, "config.json"), rawConfig, 0o644); err != nil {
 		return err
 	}
-
-	return nil
+	if err := os.WriteFile(filepath.Join(dest, platformFile), []byte(got.String()+"\n"), 0o644); err != nil {
+		return err
+	}
+	// written last: its presence marks the image as complete
+	return os.WriteFile(filepath.Join(dest, "manifest.json"), rawManifest, 0o644)
 }
 
-func getToken(ref ImageRef) (string, error) {
-	v := url.Values{}
-	v.Set("service", "registry.docker.io")
-	v.Set("scope", "repository:"+ref.Repo+":pull")
-	u := url.URL{Scheme: "https", Host: "auth.docker.io", Path: "/token", RawQuery: v.Encode()}
-	dbg("auth request: %s (scope=%q)", u.String(), v.Get("scope"))
-	resp, err := http.Get(u.String())
+// ping checks that the registry answers at all before anything is
+// fetched, and picks up its authentication challenge, if it has one.
+// Registries on this machine may speak plain HTTP, as docker allows for
+// loopback addresses by default.
+func ping(ref ImageRef, auth *authorizer) (ImageRef, error) {
+	resp, err := doGET(ref.baseURL()+"/v2/", nil)
+	if err != nil && isLoopback(ref.Registry) {
+		dbg("ping %s: %v; trying plain HTTP", ref.Registry, err)
+		ref.plainHTTP = true
+		resp, err = doGET(ref.baseURL()+"/v2/", nil)
+	}
 	if err != nil {
-		return "", err
+		return ref, fmt.Errorf("registry %s: %w", ref.Registry, err)
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("auth: %s", resp.Status)
-	}
-	var tmp struct {
-		Token string `json:"token"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&tmp); err != nil {
-		return "", err
-	}
-	if len(tmp.Token) > 16 {
-		dbg("auth OK: token=%s...", tmp.Token[:16])
-	} else {
-		dbg("auth OK: token(len=%d)", len(tmp.Token))
-	}
-	if tmp.Token == "" {
-		return "", errors.New("empty token")
+	if resp.StatusCode == http.StatusUnauthorized {
+		auth.observe(resp)
 	}
-	return tmp.Token, nil
+	return ref, nil
 }
 
-func getManifestAndConfig(ref ImageRef, token string) (*Manifest, []byte, error) {
-
-	req, _ := http.NewRequest("GET", "https://"+ref.Registry+"/v2/"+ref.Repo+"/manifests/"+ref.Tag, nil)
+// getManifestAndConfig returns the image manifest for platform, as
+// parsed and raw bytes, and the raw image config.
+func getManifestAndConfig(ref ImageRef, auth *authorizer, blobs *BlobStore, platform Platform) (*Manifest, []byte, []byte, error) {
+	req, _ := http.NewRequest("GET", ref.baseURL()+"/v2/"+ref.Repo+"/manifests/"+ref.Reference(), nil)
 	req.Header.Set("Accept", strings.Join([]string{
 		"application/vnd.docker.distribution.manifest.v2+json",
 		"application/vnd.docker.distribution.manifest.list.v2+json",
 		"application/vnd.oci.image.manifest.v1+json",
 		"application/vnd.oci.image.index.v1+json",
 	}, ", "))
-	req.Header.Set("Authorization", "Bearer "+token)
-	resp, err := authClient().Do(req)
+	resp, err := auth.do(req)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	dbg("manifest GET %s -> %s", req.URL.String(), resp.Status)
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return nil, nil, fmt.Errorf("manifest: %s", resp.Status)
+		return nil, nil, nil, fmt.Errorf("manifest: %s", resp.Status)
 	}
 
 	ct := resp.Header.Get("Content-Type")
 	dbg("manifest content-type: %s", ct)
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
+	}
+	digest, err := blobs.PutBytes(body)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if ref.Digest != "" && digest != ref.Digest {
+		return nil, nil, nil, fmt.Errorf("manifest: digest mismatch: got %s want %s", digest, ref.Digest)
 	}
 
 	if strings.Contains(ct, "manifest.list.v2+json") || strings.Contains(ct, "image.index.v1+json") {
 		var ml ManifestList
 		if err := json.Unmarshal(body, &ml); err != nil {
-			return nil, nil, err
-		}
-		pick := ""
-		for _, m := range ml.Manifests { // prefer linux/arm64
-			if m.Platform.OS == "linux" && m.Platform.Architecture == "arm64" {
-				pick = m.Digest
-				break
-			}
+			return nil, nil, nil, err
 		}
-		if pick == "" {
-			for _, m := range ml.Manifests { // fallback linux/amd64
-				if m.Platform.OS == "linux" && m.Platform.Architecture == "amd64" {
-					pick = m.Digest
-					break
-				}
-			}
-		}
-		if pick == "" {
-			return nil, nil, fmt.Errorf("no suitable platform in manifest list")
+		pick, p, err := selectManifest(&ml, platform)
+		if err != nil {
+			return nil, nil, nil, err
 		}
-		dbg("selected platform manifest digest: %s", pick)
+		dbg("selected %s manifest digest: %s", p, pick)
 
-		req2, _ := http.NewRequest("GET", "https://"+ref.Registry+"/v2/"+ref.Repo+"/manifests/"+pick, nil)
+		req2, _ := http.NewRequest("GET", ref.baseURL()+"/v2/"+ref.Repo+"/manifests/"+pick, nil)
 		req2.Header.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json,application/vnd.oci.image.manifest.v1+json")
-		req2.Header.Set("Authorization", "Bearer "+token)
-		resp2, err := authClient().Do(req2)
+		resp2, err := auth.do(req2)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 		dbg("platform manifest GET %s -> %s", req2.URL.String(), resp2.Status)
 		defer resp2.Body.Close()
 		if resp2.StatusCode != 200 {
-			return nil, nil, fmt.Errorf("manifest (platform): %s", resp2.Status)
+			return nil, nil, nil, fmt.Errorf("manifest (platform): %s", resp2.Status)
+		}
+		body2, err := io.ReadAll(resp2.Body)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if err := blobs.Put(pick, bytes.NewReader(body2)); err != nil {
+			return nil, nil, nil, fmt.Errorf("manifest (platform): %w", err)
 		}
 		var mani Manifest
-		if err := json.NewDecoder(resp2.Body).Decode(&mani); err != nil {
-			return nil, nil, err
+		if err := json.Unmarshal(body2, &mani); err != nil {
+			return nil, nil, nil, err
 		}
-		cfg, err := fetchBlob(ref, token, normalizeDigest(mani.Config.Digest))
+		cfg, err := fetchConfig(ref, auth, mani.Config.Digest, blobs)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
-		return &mani, cfg, nil
+		return &mani, body2, cfg, nil
 	}
 
 	if strings.Contains(ct, "manifest.v2+json") || strings.Contains(ct, "image.manifest.v1+json") {
 		var mani Manifest
 		if err := json.Unmarshal(body, &mani); err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
-		cfg, err := fetchBlob(ref, token, normalizeDigest(mani.Config.Digest))
+		cfg, err := fetchConfig(ref, auth, mani.Config.Digest, blobs)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
-		return &mani, cfg, nil
+		return &mani, body, cfg, nil
 	}
 
-	return nil, nil, fmt.Errorf("unsupported manifest content-type: %s", ct)
+	return nil, nil, nil, fmt.Errorf("unsupported manifest content-type: %s", ct)
 }
 
-func fetchBlob(ref ImageRef, token, digest string) ([]byte, error) {
-	digest = normalizeDigest(digest)
-	u := "https://" + ref.Registry + "/v2/" + ref.Repo + "/blobs/" + digest
-	dbg("blob GET %s", u)
-	resp, err := doGET(u, map[string]string{
-		"Authorization": "Bearer " + token,
-		"Accept":        "application/octet-stream",
-	})
-	if err != nil {
-		return nil, err
+func fetchConfig(ref ImageRef, auth *authorizer, digest string, blobs *BlobStore) ([]byte, error) {
+	if err := fetchBlob(ref, auth, digest, blobs, nil); err != nil {
+		return nil, fmt.Errorf("config: %w", err)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		dbg("blob GET -> %s", resp.Status)
-		return nil, fmt.Errorf("blob %s: %s", digest, resp.Status)
+	return blobs.Get(digest)
+}
+
+// layerFetch tracks the downloads started by fetchLayers. done[i]
+// receives the result for layer i.
+type layerFetch struct {
+	done []chan error
+	quit chan struct{}
+}
+
+// stop abandons downloads that have not started yet.
+func (f *layerFetch) stop() { close(f.quit) }
+
+// fetchLayers downloads layers into the blob store with a pool of
+// opts.MaxConcurrentDownloads workers. Downloads start in manifest order.
+func fetchLayers(ref ImageRef, auth *authorizer, layers []Layer, opts *PullOptions) *layerFetch {
+	f := &layerFetch{done: make([]chan error, len(layers)), quit: make(chan struct{})}
+	for i := range f.done {
+		f.done[i] = make(chan error, 1)
+	}
+	n := opts.MaxConcurrentDownloads
+	if n <= 0 {
+		n = DefaultMaxConcurrentDownloads
+	}
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for i := range layers {
+			select {
+			case jobs <- i:
+			case <-f.quit:
+				return
+			}
+		}
+	}()
+	for w := 0; w < n; w++ {
+		go func() {
+			for i := range jobs {
+				l := layers[i]
+				if opts.Blobs.Has(l.Digest) {
+					opts.report(l, StatusCached, l.Size)
+					f.done[i] <- nil
+					continue
+				}
+				err := fetchBlob(ref, auth, l.Digest, opts.Blobs, func(n int64) {
+					opts.report(l, StatusDownloading, n)
+				})
+				if err == nil {
+					opts.report(l, StatusDownloaded, l.Size)
+				}
+				f.done[i] <- err
+			}
+		}()
 	}
-	return io.ReadAll(resp.Body)
+	return f
 }
 
-func fetchAndApplyLayer(ref ImageRef, token, digest, dest string) error {
-	digest = normalizeDigest(digest)
-	u := "https://" + ref.Registry + "/v2/" + ref.Repo + "/blobs/" + digest
-	dbg("layer GET %s", u)
-	resp, err := doGET(u, map[string]string{
-		"Authorization": "Bearer " + token,
-		"Accept":        "application/octet-stream",
-	})
+// applyLayer unpacks a layer from the store on top of dest, decompressing
+// it according to its media type, and checks that the uncompressed tar
+// has the diffID the image config lists for it.
+func applyLayer(blobs *BlobStore, l Layer, diffID, dest string, opts *PullOptions) error {
+	c, err := layerCompression(l.MediaType)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		dbg("layer GET -> %s", resp.Status)
-		return fmt.Errorf("blob %s: %s", digest, resp.Status)
-	}
-
-	h := sha256.New()
-	tee := io.TeeReader(resp.Body, h)
-
-	var tr *tar.Reader
-	if gz, err := gzip.NewReader(tee); err == nil {
-		defer gz.Close()
-		tr = tar.NewReader(gz)
-	} else {
-		tr = tar.NewReader(tee)
+	f, err := blobs.Open(l.Digest)
+	if err != nil {
+		return err
 	}
+	defer f.Close()
 
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
-		if err := applyTarEntry(dest, hdr, tr); err != nil {
-			return err
-		}
+	rc, err := decompress(bufio.NewReader(f), c)
+	if err != nil {
+		return err
 	}
-
-	sum := "sha256:" + hex.EncodeToString(h.Sum(nil))
-	if sum != digest {
-		return fmt.Errorf("digest mismatch: got %s want %s", sum, digest)
+	// closed early on errors; the explicit Close below reports whether
+	// the stream was intact
+	defer rc.Close()
+	h := sha256.New()
+	r := io.TeeReader(rc, h)
+	if err := unpackLayer(tar.NewReader(r), dest, opts); err != nil {
+		return err
 	}
-	return nil
-}
-
-func applyTarEntry(root string, hdr *tar.Header, r io.Reader) error {
-
-	name := path.Clean("/" + hdr.Name)[1:]
-	full := filepath.Join(root, name)
-
-	base := path.Base(name)
-	dir := filepath.Dir(full)
-
-	if strings.HasPrefix(base, ".wh.") {
-		target := filepath.Join(root, path.Dir(name), strings.TrimPrefix(base, ".wh."))
-		return os.RemoveAll(target)
+	// the tar reader stops at the end-of-archive marker; the padding
+	// after it counts towards the diffID as well
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err
 	}
-	if base == ".wh..wh..opq" {
-
-		entries, _ := os.ReadDir(dir)
-		for _, e := range entries {
-			_ = os.RemoveAll(filepath.Join(dir, e.Name()))
-		}
-		return nil
+	if err := rc.Close(); err != nil {
+		return err
 	}
-
-	switch hdr.Typeflag {
-	case tar.TypeDir:
-		return os.MkdirAll(full, os.FileMode(hdr.Mode))
-	case tar.TypeReg, tar.TypeRegA:
-		if err := os.MkdirAll(dir, 0o755); err != nil {
-			return err
-		}
-		f, err := os.OpenFile(full, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode))
-		if err != nil {
-			return err
-		}
-		if _, err := io.Copy(f, r); err != nil {
-			f.Close()
-			return err
-		}
-		return f.Close()
-	case tar.TypeSymlink:
-		if err := os.MkdirAll(dir, 0o755); err != nil {
-			return err
-		}
-		_ = os.RemoveAll(full)
-		return os.Symlink(hdr.Linkname, full)
-	case tar.TypeLink:
-
-		target := filepath.Join(root, hdr.Linkname)
-		_ = os.RemoveAll(full)
-		return os.Link(target, full)
-	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
-
-		return nil
-	default:
-		return nil
+	if got := "sha256:" + hex.EncodeToString(h.Sum(nil)); got != diffID {
+		return fmt.Errorf("diff_id mismatch: got %s want %s", got, diffID)
 	}
+	return nil
 }
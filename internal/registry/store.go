@@ -0,0 +1,185 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"golang.org/x/sys/unix"
+)
+
+var digestRE = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// BlobStore is a content-addressable store for manifests, configs and
+// compressed layers, laid out as <root>/sha256/<hex>. A blob only becomes
+// visible once its content has been checked against its digest, so
+// anything found in the store can be used without downloading it again.
+type BlobStore struct {
+	root string
+}
+
+func NewBlobStore(root string) *BlobStore { return &BlobStore{root: root} }
+
+// Root returns the directory the store was created with.
+func (s *BlobStore) Root() string { return s.root }
+
+// Path returns where the blob with the given digest is stored.
+func (s *BlobStore) Path(digest string) (string, error) {
+	digest = normalizeDigest(digest)
+	if !digestRE.MatchString(digest) {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return filepath.Join(s.root, "sha256", digest[len("sha256:"):]), nil
+}
+
+func (s *BlobStore) Has(digest string) bool {
+	p, err := s.Path(digest)
+	if err != nil {
+		return false
+	}
+	fi, err := os.Stat(p)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+func (s *BlobStore) Open(digest string) (*os.File, error) {
+	p, err := s.Path(digest)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (s *BlobStore) Get(digest string) ([]byte, error) {
+	p, err := s.Path(digest)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(p)
+}
+
+// Put stores the content of r under digest. The content is written to a
+// temporary file first and only renamed into place if it matches.
+func (s *BlobStore) Put(digest string, r io.Reader) error {
+	digest = normalizeDigest(digest)
+	p, err := s.Path(digest)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if sum := "sha256:" + hex.EncodeToString(h.Sum(nil)); sum != digest {
+		return fmt.Errorf("digest mismatch: got %s want %s", sum, digest)
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// openPartial opens, creating it if needed, the file that collects an
+// interrupted download of digest, and locks it against other pulls of
+// the same blob. New data is appended at the end.
+func (s *BlobStore) openPartial(digest string) (*os.File, error) {
+	p, err := s.Path(digest)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return nil, err
+	}
+	for {
+		f, err := os.OpenFile(p+".partial", os.O_CREATE|os.O_RDWR, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("blob lock: %w", err)
+		}
+		// While we waited for the lock, its holder may have moved the
+		// file into the store or removed it, and another pull may
+		// have started a new one; only the file still at the path is
+		// ours to use.
+		if !isPartial(f, p+".partial") {
+			f.Close()
+			continue
+		}
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+}
+
+// isPartial reports whether f is the file at path p.
+func isPartial(f *os.File, p string) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	cur, err := os.Stat(p)
+	return err == nil && os.SameFile(fi, cur)
+}
+
+// discardPartial removes f, the partial download of digest locked by
+// openPartial, unless something else has taken its place.
+func (s *BlobStore) discardPartial(digest string, f *os.File) {
+	if p, err := s.Path(digest); err == nil && isPartial(f, p+".partial") {
+		os.Remove(p + ".partial")
+	}
+}
+
+// commitPartial checks the whole of a partial download against digest
+// and moves it into the store. On a mismatch the partial file is emptied
+// so that the next attempt starts over.
+func (s *BlobStore) commitPartial(digest string, f *os.File) error {
+	p, err := s.Path(digest)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if sum := "sha256:" + hex.EncodeToString(h.Sum(nil)); sum != normalizeDigest(digest) {
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		return fmt.Errorf("digest mismatch: got %s want %s", sum, normalizeDigest(digest))
+	}
+	return os.Rename(f.Name(), p)
+}
+
+// PutBytes stores b and returns its digest.
+func (s *BlobStore) PutBytes(b []byte) (string, error) {
+	sum := sha256.Sum256(b)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if s.Has(digest) {
+		return digest, nil
+	}
+	return digest, s.Put(digest, bytes.NewReader(b))
+}
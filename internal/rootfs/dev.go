@@ -0,0 +1,72 @@
+package rootfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+type device struct {
+	name         string
+	major, minor uint32
+}
+
+var defaultDevices = []device{
+	{"null", 1, 3},
+	{"zero", 1, 5},
+	{"full", 1, 7},
+	{"random", 1, 8},
+	{"urandom", 1, 9},
+	{"tty", 5, 0},
+}
+
+var defaultDevLinks = map[string]string{
+	"fd":     "/proc/self/fd",
+	"stdin":  "/proc/self/fd/0",
+	"stdout": "/proc/self/fd/1",
+	"stderr": "/proc/self/fd/2",
+	"ptmx":   "pts/ptmx",
+}
+
+// SetupDev mounts a fresh tmpfs on root/dev and populates it with the
+// minimal set of device nodes, symlinks, devpts and /dev/shm that most
+// programs expect. Device nodes are created with mknod when possible and
+// bind-mounted from the host otherwise (e.g. inside a user namespace).
+func SetupDev(root string) error {
+	if err := Mount(root, "tmpfs", "/dev", "tmpfs", unix.MS_NOSUID|unix.MS_STRICTATIME, "mode=755,size=65536k"); err != nil {
+		return err
+	}
+	dev, err := SecureJoin(root, "/dev")
+	if err != nil {
+		return err
+	}
+
+	for _, d := range defaultDevices {
+		p := filepath.Join(dev, d.name)
+		err := unix.Mknod(p, unix.S_IFCHR|0o666, int(unix.Mkdev(d.major, d.minor)))
+		if err == nil {
+			// mknod is subject to the umask
+			err = os.Chmod(p, 0o666)
+		}
+		if errors.Is(err, unix.EPERM) {
+			err = BindFile(root, "/dev/"+d.name, "/dev/"+d.name)
+		}
+		if err != nil {
+			return fmt.Errorf("/dev/%s: %w", d.name, err)
+		}
+	}
+
+	for name, target := range defaultDevLinks {
+		if err := os.Symlink(target, filepath.Join(dev, name)); err != nil {
+			return fmt.Errorf("/dev/%s: %w", name, err)
+		}
+	}
+
+	if err := Mount(root, "devpts", "/dev/pts", "devpts", unix.MS_NOSUID|unix.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620"); err != nil {
+		return err
+	}
+	return Mount(root, "shm", "/dev/shm", "tmpfs", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "mode=1777,size=65536k")
+}
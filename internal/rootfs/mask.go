@@ -0,0 +1,173 @@
+package rootfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// DefaultMaskedPaths and DefaultReadonlyPaths follow the OCI runtime
+// defaults: kernel interfaces that leak host information or let a
+// container reconfigure the host.
+var DefaultMaskedPaths = []string{
+	"/proc/acpi",
+	"/proc/asound",
+	"/proc/interrupts",
+	"/proc/kcore",
+	"/proc/keys",
+	"/proc/latency_stats",
+	"/proc/sched_debug",
+	"/proc/scsi",
+	"/proc/timer_list",
+	"/proc/timer_stats",
+	"/sys/devices/virtual/powercap",
+	"/sys/firmware",
+}
+
+var DefaultReadonlyPaths = []string{
+	"/proc/bus",
+	"/proc/fs",
+	"/proc/irq",
+	"/proc/sys",
+	"/proc/sysrq-trigger",
+}
+
+// MountSys mounts a read-only sysfs on root/sys. sysfs can only be
+// mounted by a user namespace that also owns the network namespace, so
+// without one the host /sys is bind-mounted read-only instead.
+func MountSys(root string) error {
+	const flags = unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC | unix.MS_RDONLY
+	err := Mount(root, "sysfs", "/sys", "sysfs", flags, "")
+	if err == nil || !errors.Is(err, unix.EPERM) {
+		return err
+	}
+	// the bind has to be recursive: in a user namespace the kernel
+	// refuses to split /sys from its locked submounts
+	if err := Mount(root, "/sys", "/sys", "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return err
+	}
+	dst, err := SecureJoin(root, "/sys")
+	if err != nil {
+		return err
+	}
+	if err := remountTreeReadonly(dst, unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC); err != nil {
+		return fmt.Errorf("/sys: %w", err)
+	}
+	return nil
+}
+
+// remountTreeReadonly remounts the bind mount at dst and every mount
+// below it read-only, adding flags; remounting only dst would leave the
+// submounts of a recursive bind writable. Submounts the caller cannot
+// reach are skipped, as nothing in the container can reach them either.
+func remountTreeReadonly(dst string, flags uintptr) error {
+	mounts, err := mountsUnder(dst)
+	if err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		if err := remountReadonly(m, flags); err != nil {
+			if m != dst && errors.Is(err, unix.EACCES) {
+				continue
+			}
+			return fmt.Errorf("remount %s read-only: %w", m, err)
+		}
+	}
+	return nil
+}
+
+// mountsUnder lists dir and the mount points below it, parents first.
+func mountsUnder(dir string) ([]string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	mounts := []string{dir}
+	seen := map[string]bool{dir: true}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		p := unescapeMountPath(fields[4])
+		if strings.HasPrefix(p, dir+"/") && !seen[p] {
+			seen[p] = true
+			mounts = append(mounts, p)
+		}
+	}
+	sort.SliceStable(mounts, func(i, j int) bool {
+		return strings.Count(mounts[i], "/") < strings.Count(mounts[j], "/")
+	})
+	return mounts, nil
+}
+
+// unescapeMountPath undoes the octal escapes (\040 for a space and so
+// on) of a path in /proc/self/mountinfo.
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// MaskPaths hides each path from the current root: files are covered with
+// /dev/null and directories with an empty read-only tmpfs. Paths that do
+// not exist are skipped.
+func MaskPaths(paths []string) error {
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return fmt.Errorf("mask %s: %w", p, err)
+		}
+		if fi.IsDir() {
+			err = unix.Mount("tmpfs", p, "tmpfs", unix.MS_RDONLY, "size=0")
+		} else {
+			err = unix.Mount("/dev/null", p, "", unix.MS_BIND, "")
+		}
+		if err != nil {
+			return fmt.Errorf("mask %s: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// ReadonlyPaths remounts each path read-only in the current root. Paths
+// that do not exist are skipped.
+func ReadonlyPaths(paths []string) error {
+	for _, p := range paths {
+		if err := unix.Mount(p, p, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			if errors.Is(err, unix.ENOENT) {
+				continue
+			}
+			return fmt.Errorf("readonly %s: %w", p, err)
+		}
+		if err := remountTreeReadonly(p, unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC); err != nil {
+			return fmt.Errorf("readonly %s: %w", p, err)
+		}
+	}
+	return nil
+}
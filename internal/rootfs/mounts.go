@@ -0,0 +1,182 @@
+package rootfs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// BindMount is a host path bind-mounted into the container (-v). When
+// Volume is set, Source is filled in with the named volume's directory
+// before the container starts.
+type BindMount struct {
+	Source   string
+	Volume   string
+	Target   string
+	ReadOnly bool
+}
+
+func (m BindMount) String() string {
+	src := m.Source
+	if src == "" {
+		src = m.Volume
+	}
+	s := src + ":" + m.Target
+	if m.ReadOnly {
+		s += ":ro"
+	}
+	return s
+}
+
+// ParseBindMount parses hostPath:containerPath[:ro|rw] or
+// volumeName:containerPath[:ro|rw]. A source without a slash is a volume
+// name; relative host paths are made absolute against the current
+// directory.
+func ParseBindMount(spec string) (BindMount, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return BindMount{}, fmt.Errorf("volume %q: want hostPath:containerPath[:ro|rw]", spec)
+	}
+	m := BindMount{Target: parts[1]}
+	if !path.IsAbs(m.Target) {
+		return m, fmt.Errorf("volume %q: container path must be absolute", spec)
+	}
+	if len(parts) == 3 {
+		switch parts[2] {
+		case "ro":
+			m.ReadOnly = true
+		case "rw":
+		default:
+			return m, fmt.Errorf("volume %q: unknown mode %q", spec, parts[2])
+		}
+	}
+	if !strings.Contains(parts[0], "/") && parts[0] != "." && parts[0] != ".." {
+		m.Volume = parts[0]
+		return m, nil
+	}
+	src, err := filepath.Abs(parts[0])
+	if err != nil {
+		return m, fmt.Errorf("volume %q: %w", spec, err)
+	}
+	m.Source = src
+	return m, nil
+}
+
+// TmpfsMount is a tmpfs mounted into the container (--tmpfs).
+type TmpfsMount struct {
+	Target  string
+	Options string
+}
+
+func (m TmpfsMount) String() string {
+	if m.Options == "" {
+		return m.Target
+	}
+	return m.Target + ":" + m.Options
+}
+
+// ParseTmpfsMount parses path[:opt,opt...], e.g. /run:size=64m,mode=755.
+func ParseTmpfsMount(spec string) (TmpfsMount, error) {
+	target, opts, _ := strings.Cut(spec, ":")
+	if !path.IsAbs(target) {
+		return TmpfsMount{}, fmt.Errorf("tmpfs %q: path must be absolute", spec)
+	}
+	return TmpfsMount{Target: target, Options: opts}, nil
+}
+
+// Bind performs m inside root. The mount point is created as a file or
+// directory to match the source.
+func Bind(root string, m BindMount) error {
+	st, err := os.Stat(m.Source)
+	if err != nil {
+		return fmt.Errorf("volume %s: %w", m, err)
+	}
+	dst, err := SecureJoin(root, m.Target)
+	if err != nil {
+		return err
+	}
+	if st.IsDir() {
+		if err := os.MkdirAll(dst, 0o755); err != nil {
+			return fmt.Errorf("mkdir %s: %w", m.Target, err)
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return fmt.Errorf("mkdir %s: %w", filepath.Dir(m.Target), err)
+		}
+		if err := ensureFile(dst); err != nil {
+			return fmt.Errorf("mount point %s: %w", m.Target, err)
+		}
+	}
+	if err := unix.Mount(m.Source, dst, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("volume %s: %w", m, err)
+	}
+	if m.ReadOnly {
+		// the bind is recursive, so mounts below the source are
+		// made read-only as well
+		if err := remountTreeReadonly(dst, 0); err != nil {
+			return fmt.Errorf("volume %s: %w", m, err)
+		}
+	}
+	return nil
+}
+
+// remountReadonly makes a bind mount read-only, adding flags. Flags such
+// as nosuid that the source mount already has must be kept, or the
+// kernel refuses the remount inside a user namespace.
+func remountReadonly(dst string, flags uintptr) error {
+	var sfs unix.Statfs_t
+	if err := unix.Statfs(dst, &sfs); err != nil {
+		return err
+	}
+	flags |= unix.MS_BIND | unix.MS_REMOUNT | unix.MS_RDONLY
+	for st, ms := range map[int64]uintptr{
+		unix.ST_NOSUID:      unix.MS_NOSUID,
+		unix.ST_NODEV:       unix.MS_NODEV,
+		unix.ST_NOEXEC:      unix.MS_NOEXEC,
+		unix.ST_NOATIME:     unix.MS_NOATIME,
+		unix.ST_NODIRATIME:  unix.MS_NODIRATIME,
+		unix.ST_RELATIME:    unix.MS_RELATIME,
+		unix.ST_SYNCHRONOUS: unix.MS_SYNCHRONOUS,
+	} {
+		if sfs.Flags&st != 0 {
+			flags |= ms
+		}
+	}
+	return unix.Mount("", dst, "", flags, "")
+}
+
+// MountTmpfs mounts m inside root. Mount flags such as ro or noexec may
+// be given among the options; everything else is passed to tmpfs.
+func MountTmpfs(root string, m TmpfsMount) error {
+	flags := uintptr(unix.MS_NOSUID | unix.MS_NODEV)
+	var data []string
+	if m.Options != "" {
+		for _, o := range strings.Split(m.Options, ",") {
+			switch o {
+			case "ro":
+				flags |= unix.MS_RDONLY
+			case "rw":
+				flags &^= unix.MS_RDONLY
+			case "noexec":
+				flags |= unix.MS_NOEXEC
+			case "exec":
+				flags &^= unix.MS_NOEXEC
+			case "nosuid":
+				flags |= unix.MS_NOSUID
+			case "suid":
+				flags &^= unix.MS_NOSUID
+			case "nodev":
+				flags |= unix.MS_NODEV
+			case "dev":
+				flags &^= unix.MS_NODEV
+			default:
+				data = append(data, o)
+			}
+		}
+	}
+	return Mount(root, "tmpfs", m.Target, "tmpfs", flags, strings.Join(data, ","))
+}
@@ -0,0 +1,94 @@
+package rootfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseBindMount(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		spec    string
+		want    BindMount
+		wantErr bool
+	}{
+		{spec: "/srv/data:/data", want: BindMount{Source: "/srv/data", Target: "/data"}},
+		{spec: "/srv/data:/data:ro", want: BindMount{Source: "/srv/data", Target: "/data", ReadOnly: true}},
+		{spec: "/srv/data:/data:rw", want: BindMount{Source: "/srv/data", Target: "/data"}},
+		{spec: "./conf:/etc/app", want: BindMount{Source: filepath.Join(wd, "conf"), Target: "/etc/app"}},
+		{spec: ".:/src", want: BindMount{Source: wd, Target: "/src"}},
+		{spec: "..:/src", want: BindMount{Source: filepath.Dir(wd), Target: "/src"}},
+		{spec: "cache:/var/cache", want: BindMount{Volume: "cache", Target: "/var/cache"}},
+		{spec: "cache:/var/cache:ro", want: BindMount{Volume: "cache", Target: "/var/cache", ReadOnly: true}},
+		{spec: "/srv/data", wantErr: true},
+		{spec: ":/data", wantErr: true},
+		{spec: "/srv/data:", wantErr: true},
+		{spec: "/srv/data:data", wantErr: true},
+		{spec: "/srv/data:/data:rx", wantErr: true},
+		{spec: "/a:/b:ro:x", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseBindMount(tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseBindMount(%q) = %+v, want an error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseBindMount(%q): %v", tt.spec, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseBindMount(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestBindMountString(t *testing.T) {
+	for _, spec := range []string{"/srv/data:/data", "/srv/data:/data:ro", "cache:/var/cache"} {
+		m, err := ParseBindMount(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.String(); got != spec {
+			t.Errorf("ParseBindMount(%q).String() = %q", spec, got)
+		}
+	}
+}
+
+func TestParseTmpfsMount(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    TmpfsMount
+		wantErr bool
+	}{
+		{spec: "/run", want: TmpfsMount{Target: "/run"}},
+		{spec: "/run:size=64m,mode=755", want: TmpfsMount{Target: "/run", Options: "size=64m,mode=755"}},
+		{spec: "run", wantErr: true},
+		{spec: ":size=64m", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTmpfsMount(tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseTmpfsMount(%q) = %+v, want an error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseTmpfsMount(%q): %v", tt.spec, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseTmpfsMount(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+		if s := got.String(); s != tt.spec {
+			t.Errorf("ParseTmpfsMount(%q).String() = %q", tt.spec, s)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package rootfs
+
+import "os"
+
+// SetOwner gives p to uid and gid without following symlinks, and then
+// sets its permission bits from mode: chown clears the setuid and setgid
+// bits. Symlinks have no mode of their own and are only chowned.
+func SetOwner(p string, uid, gid int, mode os.FileMode) error {
+	if err := os.Lchown(p, uid, gid); err != nil {
+		return err
+	}
+	if mode&os.ModeSymlink != 0 {
+		return nil
+	}
+	return os.Chmod(p, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+}
@@ -0,0 +1,217 @@
+package rootfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Validate resolves root to an absolute path and checks that it is a
+// directory that can be used as a container root.
+func Validate(root string) (string, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return "", fmt.Errorf("rootfs %s: %w", root, err)
+	}
+	abs, err = filepath.EvalSymlinks(abs)
+	if err != nil {
+		return "", fmt.Errorf("rootfs %s: %w", root, err)
+	}
+	if abs == "/" {
+		return "", fmt.Errorf("rootfs %s: refusing to use host root", root)
+	}
+	st, err := os.Stat(abs)
+	if err != nil {
+		return "", fmt.Errorf("rootfs %s: %w", root, err)
+	}
+	if !st.IsDir() {
+		return "", fmt.Errorf("rootfs %s: not a directory", root)
+	}
+	return abs, nil
+}
+
+// EnterChroot switches into root with a plain chroot. It is only used
+// when the caller has no private mount namespace to pivot in.
+func EnterChroot(root string) error {
+	abs, err := Validate(root)
+	if err != nil {
+		return err
+	}
+	if err := unix.Chroot(abs); err != nil {
+		return fmt.Errorf("chroot %s: %w", abs, err)
+	}
+	if err := unix.Chdir("/"); err != nil {
+		return fmt.Errorf("chdir /: %w", err)
+	}
+	return nil
+}
+
+// PivotRoot makes root the new root of the calling mount namespace and
+// detaches the old root so host mounts are no longer reachable. The
+// caller must already be in a private mount namespace. Only when
+// pivot_root fails with EINVAL and the current root is an initramfs
+// does it warn and fall back to EnterChroot; any other failure is
+// returned, since a chroot can be escaped.
+func PivotRoot(root string) error {
+	abs, err := Validate(root)
+	if err != nil {
+		return err
+	}
+
+	// pivot_root requires the new root to be a mount point.
+	if err := unix.Mount(abs, abs, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind mount %s: %w", abs, err)
+	}
+	if err := unix.Chdir(abs); err != nil {
+		return fmt.Errorf("chdir %s: %w", abs, err)
+	}
+
+	// pivot_root(".", ".") stacks the old root on top of the new one, so
+	// no directory for it has to be created in an image that the
+	// container may not be allowed to write to.
+	if err := unix.PivotRoot(".", "."); err != nil {
+		if errors.Is(err, unix.EINVAL) && onInitramfs() {
+			fmt.Fprintf(os.Stderr, "ccrun: warning: pivot_root %s: %v, falling back to chroot\n", abs, err)
+			return EnterChroot(abs)
+		}
+		return fmt.Errorf("pivot_root %s: %w", abs, err)
+	}
+	if err := unix.Mount("", ".", "", unix.MS_SLAVE|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("mount slave old root: %w", err)
+	}
+	if err := unix.Unmount(".", unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmount old root: %w", err)
+	}
+	if err := unix.Chdir("/"); err != nil {
+		return fmt.Errorf("chdir /: %w", err)
+	}
+	return nil
+}
+
+// onInitramfs reports whether / is the initial ramfs or tmpfs root, which
+// pivot_root cannot move away from. Its EINVAL otherwise means the new
+// root is unusable, for instance because its parent mount is shared.
+func onInitramfs() bool {
+	var st unix.Statfs_t
+	if err := unix.Statfs("/", &st); err != nil {
+		return false
+	}
+	return st.Type == unix.RAMFS_MAGIC || st.Type == unix.TMPFS_MAGIC
+}
+
+// SecureJoin joins unsafePath onto root, resolving symlinks as if root
+// were the filesystem root, so the result never points outside root.
+// Components that do not exist yet are joined lexically.
+func SecureJoin(root, unsafePath string) (string, error) {
+	p, err := resolvePath(unsafePath, func(p string) (string, os.FileInfo, error) {
+		full := filepath.Join(root, p)
+		fi, err := os.Lstat(full)
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil, nil
+		}
+		return full, fi, err
+	})
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, p), nil
+}
+
+// resolvePath resolves the symlinks in unsafePath within a tree whose
+// entries are found with lookup, which returns the file that provides a
+// clean absolute path of the tree, or a nil FileInfo if there is none.
+// The result is a clean absolute path of the tree without symlinks.
+func resolvePath(unsafePath string, lookup func(p string) (string, os.FileInfo, error)) (string, error) {
+	cur := "/"
+	rest := unsafePath
+	links := 0
+	for rest != "" {
+		var part string
+		part, rest, _ = strings.Cut(rest, "/")
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			cur = path.Dir(cur)
+			continue
+		}
+		next := path.Join(cur, part)
+		file, fi, err := lookup(next)
+		if err != nil {
+			return "", err
+		}
+		if fi == nil || fi.Mode()&os.ModeSymlink == 0 {
+			cur = next
+			continue
+		}
+		links++
+		if links > 255 {
+			return "", fmt.Errorf("%s: %w", unsafePath, unix.ELOOP)
+		}
+		dest, err := os.Readlink(file)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(dest) {
+			cur = "/"
+		}
+		if rest != "" {
+			dest += "/" + rest
+		}
+		rest = dest
+	}
+	return cur, nil
+}
+
+// BindFile bind-mounts the host file src over target inside root,
+// creating an empty mount point if the image does not have one.
+func BindFile(root, src, target string) error {
+	dst, err := SecureJoin(root, target)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", filepath.Dir(dst), err)
+	}
+	if err := ensureFile(dst); err != nil {
+		return fmt.Errorf("mount point %s: %w", target, err)
+	}
+	if err := unix.Mount(src, dst, "", unix.MS_BIND, ""); err != nil {
+		return fmt.Errorf("bind %s on %s: %w", src, target, err)
+	}
+	return nil
+}
+
+// Mount mounts a filesystem of type fstype on target inside root,
+// creating the mount point if needed.
+func Mount(root, source, target, fstype string, flags uintptr, data string) error {
+	dst, err := SecureJoin(root, target)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", target, err)
+	}
+	if err := unix.Mount(source, dst, fstype, flags, data); err != nil {
+		return fmt.Errorf("mount %s on %s: %w", fstype, target, err)
+	}
+	return nil
+}
+
+// ensureFile creates an empty file at p to serve as a mount point, unless
+// something already exists there.
+func ensureFile(p string) error {
+	if _, err := os.Lstat(p); err == nil {
+		return nil
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,72 @@
+package rootfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSecureJoin(t *testing.T) {
+	root := t.TempDir()
+	for _, d := range []string{"etc", "usr/lib", "var"} {
+		if err := os.MkdirAll(filepath.Join(root, d), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, dest := range map[string]string{
+		"lib":         "usr/lib",
+		"abs":         "/etc",
+		"escape":      "../../../..",
+		"absescape":   "/../../etc",
+		"var/run":     "../run",
+		"usr/lib/up":  "../../etc",
+		"usr/lib/ptr": "/lib",
+	} {
+		if err := os.Symlink(dest, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path, want string
+	}{
+		{"/etc/passwd", "etc/passwd"},
+		{"etc//./passwd", "etc/passwd"},
+		{"/../../etc", "etc"},
+		{"/lib/x", "usr/lib/x"},
+		{"/abs/hosts", "etc/hosts"},
+		{"/escape/etc", "etc"},
+		{"/absescape", "etc"},
+		{"/var/run/x", "run/x"},
+		{"/usr/lib/up/hosts", "etc/hosts"},
+		{"/usr/lib/ptr/ptr/up", "etc"},
+		{"/missing/../etc", "etc"},
+		{"/", ""},
+	}
+	for _, tt := range tests {
+		got, err := SecureJoin(root, tt.path)
+		if err != nil {
+			t.Errorf("SecureJoin(%q): %v", tt.path, err)
+			continue
+		}
+		if want := filepath.Join(root, tt.want); got != want {
+			t.Errorf("SecureJoin(%q) = %s, want %s", tt.path, got, want)
+		}
+	}
+}
+
+func TestSecureJoinLoop(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Symlink("b", filepath.Join(root, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a", filepath.Join(root, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SecureJoin(root, "/a/x"); !errors.Is(err, unix.ELOOP) {
+		t.Errorf("got %v, want ELOOP", err)
+	}
+}
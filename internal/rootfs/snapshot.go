@@ -0,0 +1,311 @@
+package rootfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Snapshot is a container's private, writable view of an image: the
+// image's layer directories stacked read-only under an upper directory
+// that receives the container's changes, so that containers never write
+// to the image itself.
+type Snapshot struct {
+	Layers []string // bottom layer first
+	Upper  string
+	Work   string
+}
+
+// Mount assembles the snapshot at target. It tries a kernel overlay
+// mount first, then fuse-overlayfs, and finally copies the layers into
+// target, which works everywhere but costs time and space. userNS tells
+// whether the caller is in a user namespace, where overlayfs keeps its
+// metadata in user.* rather than trusted.* xattrs.
+func (s Snapshot) Mount(target string, userNS bool) error {
+	if len(s.Layers) == 0 {
+		return fmt.Errorf("snapshot: no layers")
+	}
+	// overlayfs wants the topmost lower layer first
+	lower := make([]string, len(s.Layers))
+	for i, l := range s.Layers {
+		lower[len(s.Layers)-1-i] = l
+	}
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lower, ":"), s.Upper, s.Work)
+
+	kopts := opts
+	if userNS {
+		kopts += ",userxattr"
+	}
+	err := unix.Mount("overlay", target, "overlay", 0, kopts)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, unix.EPERM) && !errors.Is(err, unix.EINVAL) && !errors.Is(err, unix.ENODEV) {
+		return fmt.Errorf("mount overlay on %s: %w", target, err)
+	}
+
+	if fuse, lerr := exec.LookPath("fuse-overlayfs"); lerr == nil {
+		out, ferr := exec.Command(fuse, "-o", opts, target).CombinedOutput()
+		if ferr == nil {
+			return nil
+		}
+		err = fmt.Errorf("%w; fuse-overlayfs: %v: %s", err, ferr, strings.TrimSpace(string(out)))
+	}
+
+	fmt.Fprintf(os.Stderr, "ccrun: overlayfs unavailable (%v), copying image layers\n", err)
+	for _, l := range s.Layers {
+		if err := CopyLayer(target, l); err != nil {
+			return fmt.Errorf("snapshot: copy %s: %w", l, err)
+		}
+	}
+	return nil
+}
+
+// Lookup returns the layer directories that make up directory p of the
+// merged view, bottom first, so that applying them in order with
+// CopyLayer reproduces it. Symlinks in p are resolved in the merged view.
+// It returns none if p is not a directory there.
+func (s Snapshot) Lookup(p string) ([]string, error) {
+	resolved, err := resolvePath(p, func(p string) (string, os.FileInfo, error) {
+		files, fis, err := s.entries(p)
+		if err != nil || len(files) == 0 {
+			return "", nil, err
+		}
+		return files[0], fis[0], nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	files, fis, err := s.entries(resolved)
+	if err != nil || len(files) == 0 || !fis[0].IsDir() {
+		return nil, err
+	}
+	slices.Reverse(files)
+	return files, nil
+}
+
+// entries returns the copies of p, a clean absolute path without
+// symlinks, that are visible in the merged view, topmost first: a file
+// or a whiteout hides the layers below it, and so does an opaque
+// directory at or above p.
+func (s Snapshot) entries(p string) ([]string, []os.FileInfo, error) {
+	var files []string
+	var fis []os.FileInfo
+	for i := len(s.Layers) - 1; i >= 0; i-- {
+		file, fi, hides, err := layerEntry(s.Layers[i], p)
+		if err != nil {
+			return nil, nil, err
+		}
+		if fi != nil {
+			if isWhiteout(fi) {
+				break
+			}
+			files = append(files, file)
+			fis = append(fis, fi)
+			if !fi.IsDir() {
+				break
+			}
+		}
+		if hides {
+			break
+		}
+	}
+	return files, fis, nil
+}
+
+// layerEntry looks up p in one layer. It returns a nil FileInfo if the
+// layer has nothing there, and reports whether the layer hides p in the
+// layers below it.
+func layerEntry(layer, p string) (string, os.FileInfo, bool, error) {
+	cur := layer
+	hides := false
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	if parts[0] == "" {
+		parts = nil
+	}
+	for i, part := range parts {
+		cur = filepath.Join(cur, part)
+		fi, err := os.Lstat(cur)
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil, hides, nil
+		}
+		if err != nil {
+			return "", nil, false, err
+		}
+		if i < len(parts)-1 && !fi.IsDir() {
+			// a file or a whiteout in the way hides the lower layers
+			return "", nil, true, nil
+		}
+		if fi.IsDir() && isOpaque(cur) {
+			hides = true
+		}
+		if i == len(parts)-1 {
+			return cur, fi, hides, nil
+		}
+	}
+	fi, err := os.Lstat(layer)
+	return layer, fi, false, err
+}
+
+// isWhiteout reports whether fi is an overlayfs whiteout, a 0:0
+// character device.
+func isWhiteout(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && fi.Mode()&os.ModeCharDevice != 0 && st.Rdev == 0
+}
+
+func isOpaque(dir string) bool {
+	buf := make([]byte, 1)
+	for _, name := range []string{"trusted.overlay.opaque", "user.overlay.opaque"} {
+		if n, err := unix.Lgetxattr(dir, name, buf); err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
+
+// CopyLayer applies one overlay-format layer directory on top of dst,
+// honouring whiteouts and opaque directories, and keeping owners, modes,
+// times and xattrs. Directories are visited before their contents, and
+// anything in dst that is in the way of a directory is replaced, so a
+// symlink left by a lower layer can never redirect the copy.
+func CopyLayer(dst, layer string) error {
+	return filepath.Walk(layer, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(layer, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if rel != "." && isWhiteout(fi) {
+			return os.RemoveAll(target)
+		}
+
+		existing, err := os.Lstat(target)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if existing != nil && (rel == "." || fi.IsDir()) && existing.IsDir() {
+			if rel != "." && isOpaque(p) {
+				entries, err := os.ReadDir(target)
+				if err != nil {
+					return err
+				}
+				for _, e := range entries {
+					if err := os.RemoveAll(filepath.Join(target, e.Name())); err != nil {
+						return err
+					}
+				}
+			}
+		} else if existing != nil {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+
+		st := fi.Sys().(*syscall.Stat_t)
+		switch {
+		case fi.IsDir():
+			if err := os.Mkdir(target, 0o700); err != nil && !os.IsExist(err) {
+				return err
+			}
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+			return SetOwner(target, int(st.Uid), int(st.Gid), fi.Mode())
+		case fi.Mode().IsRegular():
+			if err := copyRegular(target, p); err != nil {
+				return err
+			}
+		default:
+			if err := unix.Mknod(target, st.Mode, int(st.Rdev)); err != nil {
+				// device nodes need privileges; /dev is set up separately
+				if errors.Is(err, unix.EPERM) {
+					return nil
+				}
+				return err
+			}
+		}
+		if err := SetOwner(target, int(st.Uid), int(st.Gid), fi.Mode()); err != nil {
+			return err
+		}
+		if err := copyXattrs(target, p); err != nil {
+			return err
+		}
+		ts := []unix.Timespec{
+			{Sec: st.Atim.Sec, Nsec: st.Atim.Nsec},
+			{Sec: st.Mtim.Sec, Nsec: st.Mtim.Nsec},
+		}
+		return unix.UtimesNanoAt(unix.AT_FDCWD, target, ts, unix.AT_SYMLINK_NOFOLLOW)
+	})
+}
+
+// copyXattrs copies the xattrs of src to dst, except overlayfs's own.
+// Xattrs outside the user namespace that cannot be set without root on
+// the host are skipped, as on extraction.
+func copyXattrs(dst, src string) error {
+	size, err := unix.Llistxattr(src, nil)
+	if err != nil || size == 0 {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil
+		}
+		return err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(src, buf)
+	if err != nil {
+		return err
+	}
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if strings.HasPrefix(name, "trusted.overlay.") || strings.HasPrefix(name, "user.overlay.") {
+			continue
+		}
+		n, err := unix.Lgetxattr(src, name, nil)
+		if err != nil {
+			return err
+		}
+		value := make([]byte, n)
+		if n, err = unix.Lgetxattr(src, name, value); err != nil {
+			return err
+		}
+		if err := unix.Lsetxattr(dst, name, value[:n], 0); err != nil {
+			if errors.Is(err, unix.ENOTSUP) || (errors.Is(err, unix.EPERM) && !strings.HasPrefix(name, "user.")) {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func copyRegular(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY|unix.O_NOFOLLOW, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,218 @@
+package rootfs
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// layerFile creates p in layer as kind: "f" a file with body, "d" a
+// directory, "l" a symlink to body, "w" a whiteout and "o" an opaque
+// directory.
+func layerFile(t *testing.T, layer, p, kind, body string) {
+	t.Helper()
+	full := filepath.Join(layer, p)
+	if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	switch kind {
+	case "f":
+		err = os.WriteFile(full, []byte(body), 0o644)
+	case "d":
+		err = os.MkdirAll(full, 0o755)
+	case "l":
+		err = os.Symlink(body, full)
+	case "w":
+		if err = unix.Mknod(full, unix.S_IFCHR|0o600, 0); err != nil {
+			t.Skip("cannot create whiteouts:", err)
+		}
+	case "o":
+		if err = os.MkdirAll(full, 0o755); err == nil {
+			if err = unix.Lsetxattr(full, "user.overlay.opaque", []byte("y"), 0); err != nil {
+				t.Skip("cannot mark directories opaque:", err)
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tree lists the files below dir as path[=body] lines.
+func tree(t *testing.T, dir string) string {
+	t.Helper()
+	var out []string
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		switch {
+		case fi.Mode().IsRegular():
+			b, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			rel += "=" + string(b)
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, _ := os.Readlink(p)
+			rel += "->" + link
+		case fi.IsDir():
+			rel += "/"
+		}
+		out = append(out, rel)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(out)
+	return strings.Join(out, " ")
+}
+
+func testSnapshot(t *testing.T) Snapshot {
+	root := t.TempDir()
+	var s Snapshot
+	for i := 0; i < 3; i++ {
+		s.Layers = append(s.Layers, filepath.Join(root, string(rune('0'+i))))
+		if err := os.Mkdir(s.Layers[i], 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l0, l1, l2 := s.Layers[0], s.Layers[1], s.Layers[2]
+	layerFile(t, l0, "data/a", "f", "a0")
+	layerFile(t, l0, "data/gone", "f", "gone")
+	layerFile(t, l0, "data/sub/x", "f", "x")
+	layerFile(t, l0, "other/o", "f", "o")
+	layerFile(t, l0, "op/z", "f", "z")
+	layerFile(t, l0, "lib/real/r", "f", "r")
+	layerFile(t, l1, "data/a", "f", "a1")
+	layerFile(t, l1, "data/b", "f", "b")
+	layerFile(t, l1, "data/gone", "w", "")
+	layerFile(t, l1, "other", "w", "")
+	layerFile(t, l1, "link", "l", "/data")
+	layerFile(t, l1, "lib/alias", "l", "real")
+	layerFile(t, l2, "data/sub", "o", "")
+	layerFile(t, l2, "data/sub/y", "f", "y")
+	layerFile(t, l2, "op", "o", "")
+	layerFile(t, l2, "op/w", "f", "w")
+	layerFile(t, l2, "lib/real/r2", "f", "r2")
+	return s
+}
+
+func TestSnapshotLookup(t *testing.T) {
+	s := testSnapshot(t)
+	tests := []struct {
+		path string
+		want string // the merged directory, "" for none
+	}{
+		{"/data", "a=a1 b=b sub/ sub/y=y"},
+		{"data/", "a=a1 b=b sub/ sub/y=y"},
+		{"/link", "a=a1 b=b sub/ sub/y=y"},
+		{"/link/sub", "y=y"},
+		{"/op", "w=w"},
+		// the symlink is in one layer and its target spread over two
+		{"/lib/alias", "r2=r2 r=r"},
+		{"/other", ""},
+		{"/data/a", ""},
+		{"/missing", ""},
+	}
+	for _, tt := range tests {
+		dirs, err := s.Lookup(tt.path)
+		if err != nil {
+			t.Errorf("Lookup(%q): %v", tt.path, err)
+			continue
+		}
+		if tt.want == "" {
+			if len(dirs) != 0 {
+				t.Errorf("Lookup(%q) = %v, want none", tt.path, dirs)
+			}
+			continue
+		}
+		dst := t.TempDir()
+		for _, d := range dirs {
+			if err := CopyLayer(dst, d); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := tree(t, dst); got != tt.want {
+			t.Errorf("Lookup(%q) merges to %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCopyLayer(t *testing.T) {
+	lower, upper := t.TempDir(), t.TempDir()
+	outside := t.TempDir()
+	layerFile(t, lower, "keep", "f", "keep")
+	layerFile(t, lower, "gone", "f", "gone")
+	layerFile(t, lower, "gonedir/f", "f", "f")
+	layerFile(t, lower, "op/old", "f", "old")
+	layerFile(t, lower, "merged/a", "f", "a")
+	layerFile(t, lower, "redirect", "l", outside)
+	layerFile(t, lower, "wasfile", "f", "file")
+	layerFile(t, upper, "gone", "w", "")
+	layerFile(t, upper, "gonedir", "w", "")
+	layerFile(t, upper, "op", "o", "")
+	layerFile(t, upper, "op/new", "f", "new")
+	layerFile(t, upper, "merged/b", "f", "b")
+	// a directory where the lower layer has a symlink must not be
+	// written through it
+	layerFile(t, upper, "redirect/f", "f", "f")
+	layerFile(t, upper, "wasfile/f", "f", "f")
+
+	dst := t.TempDir()
+	for _, l := range []string{lower, upper} {
+		if err := CopyLayer(dst, l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := "keep=keep merged/ merged/a=a merged/b=b op/ op/new=new redirect/ redirect/f=f wasfile/ wasfile/f=f"
+	if got := tree(t, dst); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("copy followed a symlink out of the tree: %v", entries)
+	}
+	buf := make([]byte, 1)
+	if _, err := unix.Lgetxattr(filepath.Join(dst, "op"), "user.overlay.opaque", buf); err == nil {
+		t.Error("overlay xattr copied")
+	}
+}
+
+func TestCopyLayerKeepsModeAndTimes(t *testing.T) {
+	layer := t.TempDir()
+	layerFile(t, layer, "d/f", "f", "data")
+	f := filepath.Join(layer, "d", "f")
+	if err := os.Chmod(f, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(layer, "d"), 0o710); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1000000000, 0)
+	if err := os.Chtimes(f, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	if err := CopyLayer(dst, layer); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Lstat(filepath.Join(dst, "d", "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o640 || !fi.ModTime().Equal(mtime) {
+		t.Errorf("f: mode %v, mtime %v; want 0640 and %v", fi.Mode(), fi.ModTime(), mtime)
+	}
+	if di, err := os.Lstat(filepath.Join(dst, "d")); err != nil || di.Mode().Perm() != 0o710 {
+		t.Errorf("d: %v, %v; want mode 0710", di.Mode(), err)
+	}
+}
@@ -3,9 +3,16 @@ package run
 import (
 	"os"
 	"os/exec"
+	"syscall"
 )
 
 func ExecPassthrough(cmd string, args []string, env []string) (int, error) {
+	return ExecAs(cmd, args, env, nil)
+}
+
+// ExecAs is ExecPassthrough with the command running under cred. A nil
+// cred keeps the caller's identity.
+func ExecAs(cmd string, args []string, env []string, cred *syscall.Credential) (int, error) {
 	c := exec.Command(cmd, args...)
 	c.Env = env
 	c.Stdin = os.Stdin
@@ -14,6 +21,9 @@ func ExecPassthrough(cmd string, args []string, env []string) (int, error) {
 	if env != nil {
 		c.Env = env
 	}
+	if cred != nil {
+		c.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	}
 	if err := c.Run(); err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			return exitErr.ExitCode(), nil
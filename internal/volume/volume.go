@@ -0,0 +1,242 @@
+package volume
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/alafilearnstocode/ccrun/internal/rootfs"
+	"golang.org/x/sys/unix"
+)
+
+var nameRE = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Volume is a directory managed by ccrun that outlives containers. It is
+// stored as <stateDir>/volumes/<name>/{volume.json,_data}.
+type Volume struct {
+	Name       string    `json:"name"`
+	Mountpoint string    `json:"mountpoint"`
+	CreatedAt  time.Time `json:"createdAt"`
+	Seeded     bool      `json:"seeded"`
+	Users      []int     `json:"users,omitempty"` // pids of ccrun processes using it
+}
+
+// IsName reports whether s names a volume rather than a host path.
+func IsName(s string) bool { return nameRE.MatchString(s) }
+
+func volumesDir(stateDir string) string { return filepath.Join(stateDir, "volumes") }
+
+func metaPath(stateDir, name string) string {
+	return filepath.Join(volumesDir(stateDir), name, "volume.json")
+}
+
+// withLock serializes all volume bookkeeping under stateDir.
+func withLock(stateDir string, fn func() error) error {
+	dir := volumesDir(stateDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, ".lock"), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("volume lock: %w", err)
+	}
+	defer unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+	return fn()
+}
+
+func load(stateDir, name string) (*Volume, error) {
+	b, err := os.ReadFile(metaPath(stateDir, name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("volume %s: no such volume", name)
+		}
+		return nil, err
+	}
+	v := &Volume{}
+	if err := json.Unmarshal(b, v); err != nil {
+		return nil, fmt.Errorf("volume %s: %w", name, err)
+	}
+	// drop users whose ccrun process is gone (e.g. killed)
+	live := v.Users[:0]
+	for _, pid := range v.Users {
+		if unix.Kill(pid, 0) != unix.ESRCH {
+			live = append(live, pid)
+		}
+	}
+	v.Users = live
+	return v, nil
+}
+
+func save(stateDir string, v *Volume) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	p := metaPath(stateDir, v.Name)
+	if err := os.WriteFile(p+".tmp", b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+func create(stateDir, name string) (*Volume, error) {
+	if !IsName(name) {
+		return nil, fmt.Errorf("volume %q: invalid name", name)
+	}
+	if v, err := load(stateDir, name); err == nil {
+		return v, nil
+	}
+	abs, err := filepath.Abs(filepath.Join(volumesDir(stateDir), name, "_data"))
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(abs, 0o755); err != nil {
+		return nil, err
+	}
+	v := &Volume{Name: name, Mountpoint: abs, CreatedAt: time.Now().UTC()}
+	return v, save(stateDir, v)
+}
+
+// Create creates a volume. Creating a volume that already exists returns
+// the existing one.
+func Create(stateDir, name string) (*Volume, error) {
+	var v *Volume
+	err := withLock(stateDir, func() (err error) {
+		v, err = create(stateDir, name)
+		return err
+	})
+	return v, err
+}
+
+func Inspect(stateDir, name string) (*Volume, error) {
+	var v *Volume
+	err := withLock(stateDir, func() (err error) {
+		v, err = load(stateDir, name)
+		return err
+	})
+	return v, err
+}
+
+func List(stateDir string) ([]*Volume, error) {
+	var out []*Volume
+	err := withLock(stateDir, func() error {
+		entries, err := os.ReadDir(volumesDir(stateDir))
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if !e.IsDir() {
+				continue
+			}
+			v, err := load(stateDir, e.Name())
+			if err != nil {
+				continue
+			}
+			out = append(out, v)
+		}
+		return nil
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, err
+}
+
+// Remove deletes a volume and its data. It refuses while a running
+// container uses the volume unless force is set. The volume's directory
+// is removed with remove, which must cope with data that belongs to the
+// users of the containers; see ns.Remover.
+func Remove(stateDir, name string, force bool, remove func(dir string) error) error {
+	return withLock(stateDir, func() error {
+		v, err := load(stateDir, name)
+		if err != nil {
+			return err
+		}
+		if len(v.Users) > 0 && !force {
+			return fmt.Errorf("volume %s: in use by %d container(s)", name, len(v.Users))
+		}
+		return remove(filepath.Join(volumesDir(stateDir), name))
+	})
+}
+
+// Acquire registers pid as a user of the named volume, creating it if
+// needed. On first use, seed is called with the volume's _data
+// directory to prepare it for the container; see Seed.
+func Acquire(stateDir, name string, pid int, seed func(dir string) error) (*Volume, error) {
+	var v *Volume
+	err := withLock(stateDir, func() (err error) {
+		v, err = create(stateDir, name)
+		if err != nil {
+			return err
+		}
+		if !v.Seeded {
+			if err := seed(v.Mountpoint); err != nil {
+				return fmt.Errorf("volume %s: seed: %w", name, err)
+			}
+			v.Seeded = true
+		}
+		v.Users = append(v.Users, pid)
+		return save(stateDir, v)
+	})
+	return v, err
+}
+
+// Release drops pid from the users of the named volume.
+func Release(stateDir, name string, pid int) error {
+	return withLock(stateDir, func() error {
+		v, err := load(stateDir, name)
+		if err != nil {
+			return err
+		}
+		users := v.Users[:0]
+		for _, u := range v.Users {
+			if u != pid {
+				users = append(users, u)
+			}
+		}
+		v.Users = users
+		return save(stateDir, v)
+	})
+}
+
+// Seed prepares the _data directory dst of a volume for its first
+// container. It is given to uid and gid, the host ids of the container's
+// root, so that root in the container can write to it. If the image has
+// a directory at the mount target and dst is empty, dst becomes a copy
+// of it instead, with its owners, modes, times and xattrs: srcs are the
+// layer directories that make it up, bottom first, as returned by
+// rootfs.Snapshot.Lookup.
+func Seed(dst string, srcs []string, uid, gid int) error {
+	if err := rootfs.SetOwner(dst, uid, gid, os.ModeDir|0o755); err != nil {
+		return err
+	}
+	var dirs []string
+	for _, src := range srcs {
+		if st, err := os.Stat(src); err == nil && st.IsDir() {
+			dirs = append(dirs, src)
+		}
+	}
+	if len(dirs) == 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(dst)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return nil
+	}
+	for _, src := range dirs {
+		if err := rootfs.CopyLayer(dst, src); err != nil {
+			return err
+		}
+	}
+	return nil
+}
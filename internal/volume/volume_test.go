@@ -0,0 +1,99 @@
+package volume
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSeedKeepsMetadata(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to chown")
+	}
+	src, dst := t.TempDir(), t.TempDir()
+	if err := os.Mkdir(filepath.Join(src, "d"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	f := filepath.Join(src, "d", "f")
+	if err := os.WriteFile(f, []byte("data"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Lchown(f, 101000, 101001); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1000000000, 0)
+	if err := os.Chtimes(f, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	xattrs := unix.Setxattr(f, "user.test", []byte("x"), 0) == nil
+
+	if err := Seed(dst, []string{src}, 100000, 100000); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Lstat(filepath.Join(dst, "d", "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	if st.Uid != 101000 || st.Gid != 101001 {
+		t.Errorf("f: owned by %d:%d, want 101000:101001", st.Uid, st.Gid)
+	}
+	if fi.Mode().Perm() != 0o640 || !fi.ModTime().Equal(mtime) {
+		t.Errorf("f: mode %v, mtime %v", fi.Mode(), fi.ModTime())
+	}
+	buf := make([]byte, 1)
+	if _, err := unix.Lgetxattr(filepath.Join(dst, "d", "f"), "user.test", buf); xattrs && err != nil {
+		t.Errorf("f: xattr not copied: %v", err)
+	}
+
+	// without anything to copy, the volume is given to the container's
+	// root
+	empty := t.TempDir()
+	if err := Seed(empty, []string{filepath.Join(src, "missing")}, 100000, 100000); err != nil {
+		t.Fatal(err)
+	}
+	var est unix.Stat_t
+	if err := unix.Lstat(empty, &est); err != nil {
+		t.Fatal(err)
+	}
+	if est.Uid != 100000 || est.Gid != 100000 {
+		t.Errorf("empty volume: owned by %d:%d, want 100000:100000", est.Uid, est.Gid)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	state := t.TempDir()
+	noSeed := func(string) error { return nil }
+	v, err := Acquire(state, "data", os.Getpid(), noSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(v.Mountpoint, "f"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var removed []string
+	remove := func(dir string) error {
+		removed = append(removed, dir)
+		return os.RemoveAll(dir)
+	}
+	if err := Remove(state, "data", false, remove); err == nil {
+		t.Fatal("removed a volume in use")
+	}
+	if err := Release(state, "data", os.Getpid()); err != nil {
+		t.Fatal(err)
+	}
+	if err := Remove(state, "data", false, remove); err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != filepath.Dir(v.Mountpoint) {
+		t.Errorf("removed %v, want the volume's directory %s", removed, filepath.Dir(v.Mountpoint))
+	}
+	if _, err := Inspect(state, "data"); err == nil {
+		t.Error("volume still there after Remove")
+	}
+}